@@ -0,0 +1,274 @@
+package hehtlc
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/btcsuite/btcd/blockchain"
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/mempool"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"math"
+)
+
+// AnchorType selects the anchor outputs the presigned transactions carry, so
+// their fee can be bumped with a CPFP child once they are broadcast.
+type AnchorType int
+
+const (
+	// AnchorNone adds no anchor: the fee is fixed when the tree is signed.
+	AnchorNone AnchorType = iota
+
+	// AnchorKeyed adds a P2WPKH anchor to each of Alice's and Bob's contract
+	// keys, so only they can bump.
+	AnchorKeyed
+
+	// AnchorEphemeral adds a single pay-to-anchor (P2A) output anyone can
+	// spend with an empty witness.
+	AnchorEphemeral
+)
+
+func (anchor AnchorType) String() string {
+	switch anchor {
+	case AnchorNone:
+		return "none"
+	case AnchorKeyed:
+		return "keyed"
+	case AnchorEphemeral:
+		return "ephemeral"
+	default:
+		return fmt.Sprintf("AnchorType(%d)", int(anchor))
+	}
+}
+
+// Anchor values: the 330 sats of Lightning anchors for each keyed anchor and
+// the dust threshold of a P2A output.
+const (
+	KeyedAnchorValue     = 330
+	EphemeralAnchorValue = 240
+)
+
+// payToAnchorScript is the P2A output script, OP_1 <0x4e73>.
+var payToAnchorScript = []byte{txscript.OP_1, txscript.OP_DATA_2, 0x4e, 0x73}
+
+// p2wpkhWitnessSize is the estimated witness of a P2WPKH input: a signature
+// at its largest and a compressed public key.
+const p2wpkhWitnessSize = 1 + 1 + maxECDSASignatureSize + 1 + 33
+
+// anchorOutputs returns the anchor outputs of every presigned transaction.
+func anchorOutputs(params *Parameters) ([]*wire.TxOut, error) {
+	switch params.Anchors {
+	case AnchorNone:
+		return nil, nil
+	case AnchorKeyed:
+		var outputs []*wire.TxOut
+		for _, role := range []Role{RoleAlice, RoleBob} {
+			pkScript, err := anchorScript(params, role)
+			if err != nil {
+				return nil, err
+			}
+			outputs = append(outputs, wire.NewTxOut(KeyedAnchorValue, pkScript))
+		}
+		return outputs, nil
+	case AnchorEphemeral:
+		return []*wire.TxOut{wire.NewTxOut(EphemeralAnchorValue, payToAnchorScript)}, nil
+	default:
+		return nil, paramErrorf("Anchors", ErrInvalidAnchor, "unknown type %v", params.Anchors)
+	}
+}
+
+// anchorScript returns the output script of the anchor role may spend.
+func anchorScript(params *Parameters, role Role) ([]byte, error) {
+	if params.Anchors == AnchorEphemeral {
+		return payToAnchorScript, nil
+	}
+
+	pubKey := params.Terms.AlicePubKey
+	if role == RoleBob {
+		pubKey = params.Terms.BobPubKey
+	}
+	addr, err := btcutil.NewAddressWitnessPubKeyHash(btcutil.Hash160(pubKey.SerializeCompressed()),
+		params.Terms.Net)
+	if err != nil {
+		return nil, err
+	}
+	return txscript.PayToAddrScript(addr)
+}
+
+// anchorValue returns what the anchors of one transaction are worth.
+func (params *Parameters) anchorValue() int64 {
+	switch params.Anchors {
+	case AnchorKeyed:
+		return 2 * KeyedAnchorValue
+	case AnchorEphemeral:
+		return EphemeralAnchorValue
+	default:
+		return 0
+	}
+}
+
+// addAnchors appends the anchor outputs to tx.
+func addAnchors(params *Parameters, tx *wire.MsgTx) error {
+	outputs, err := anchorOutputs(params)
+	if err != nil {
+		return err
+	}
+	for _, txOut := range outputs {
+		tx.AddTxOut(txOut)
+	}
+	return nil
+}
+
+// isPayToAnchor reports whether pkScript is the P2A output script.
+func isPayToAnchor(pkScript []byte) bool {
+	return bytes.Equal(pkScript, payToAnchorScript)
+}
+
+// WalletInput is a wallet UTXO funding a CPFP child.
+type WalletInput struct {
+	OutPoint wire.OutPoint
+	TxOut    *wire.TxOut
+
+	// WitnessSize is the estimated size of the witness spending it, that of
+	// P2WPKH when zero.
+	WitnessSize int
+}
+
+// AnchorChild is a CPFP child spending an anchor of a presigned transaction,
+// input 0, and a wallet UTXO, input 1, into a single change output.
+type AnchorChild struct {
+	Tx *wire.MsgTx
+
+	// PrevOuts are the outputs both inputs spend, for signing the wallet
+	// input and verifying the child.
+	PrevOuts *txscript.MultiPrevOutFetcher
+
+	// Fee is what the child pays and PackageFeeRate the estimated feerate of
+	// parent and child together.
+	Fee            int64
+	PackageFeeRate float64
+
+	role Role
+}
+
+// NewAnchorChild builds the child of parent, a signed presigned transaction,
+// that brings the feerate of both to feeRate sat/vB. It spends the anchor of
+// role, any anchor for AnchorEphemeral, and wallet, and sends what is left to
+// changeAddr. The child pays at least the minimum relay fee of its own size
+// and at most MaxFee.
+func NewAnchorChild(params *Parameters, parent *SignedSpend, role Role, wallet *WalletInput,
+	feeRate float64, changeAddr string) (*AnchorChild, error) {
+
+	if params.Anchors == AnchorNone {
+		return nil, paramErrorf("Anchors", ErrInvalidAnchor, "the presigned transactions have no anchor")
+	}
+	if feeRate <= 0 {
+		return nil, paramErrorf("FeeRate", ErrNonPositiveAmount, "got %v", feeRate)
+	}
+	if wallet == nil || wallet.TxOut == nil {
+		return nil, &ParamError{Field: "WalletInput", Err: ErrMissingValue}
+	}
+
+	pkScript, err := anchorScript(params, role)
+	if err != nil {
+		return nil, err
+	}
+	anchorIndex := -1
+	for i, txOut := range parent.Tx.TxOut {
+		if bytes.Equal(txOut.PkScript, pkScript) {
+			anchorIndex = i
+			break
+		}
+	}
+	if anchorIndex < 0 {
+		return nil, paramErrorf("Anchors", ErrInvalidAnchor, "%v %v has no anchor for %v",
+			parent.Path, parent.TxID, role)
+	}
+	anchorOutPoint := wire.NewOutPoint(&parent.TxID, uint32(anchorIndex))
+	anchor := parent.Tx.TxOut[anchorIndex]
+
+	addr, err := decodeAddress(changeAddr, params.Terms.Net)
+	if err != nil {
+		return nil, &ParamError{Field: "ChangeAddress", Err: err}
+	}
+	changePkScript, err := txscript.PayToAddrScript(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	tx := wire.NewMsgTx(2)
+	tx.AddTxIn(wire.NewTxIn(anchorOutPoint, nil, nil))
+	tx.AddTxIn(wire.NewTxIn(&wallet.OutPoint, nil, nil))
+	change := wire.NewTxOut(0, changePkScript)
+	tx.AddTxOut(change)
+
+	// a P2A input has an empty witness, which still counts its item count
+	anchorWitnessSize := 1
+	if params.Anchors == AnchorKeyed {
+		anchorWitnessSize = p2wpkhWitnessSize
+	}
+	walletWitnessSize := wallet.WitnessSize
+	if walletWitnessSize == 0 {
+		walletWitnessSize = p2wpkhWitnessSize
+	}
+	weight := int64(tx.SerializeSizeStripped()*blockchain.WitnessScaleFactor + 2 +
+		anchorWitnessSize + walletWitnessSize)
+	vsize := (weight + blockchain.WitnessScaleFactor - 1) / blockchain.WitnessScaleFactor
+
+	fee := int64(math.Ceil(feeRate*float64(parent.VSize+vsize))) - parent.Fee
+	if minFee := vsize * int64(mempool.DefaultMinRelayTxFee) / 1000; fee < minFee {
+		fee = minFee
+	}
+	maxFee := params.MaxFee
+	if maxFee == 0 {
+		maxFee = DefaultMaxFee
+	}
+	if fee > maxFee {
+		return nil, paramErrorf("FeeRate", ErrAbsurdFee, "child fee %d above %d", fee, maxFee)
+	}
+
+	change.Value = anchor.Value + wallet.TxOut.Value - fee
+	if change.Value <= 0 || mempool.IsDust(change, mempool.DefaultMinRelayTxFee) {
+		return nil, paramErrorf("WalletInput", ErrDustOutput, "child fee %d leaves %d to change",
+			fee, change.Value)
+	}
+
+	prevOuts := txscript.NewMultiPrevOutFetcher(map[wire.OutPoint]*wire.TxOut{
+		*anchorOutPoint: anchor,
+		wallet.OutPoint: wallet.TxOut,
+	})
+
+	return &AnchorChild{
+		Tx:             tx,
+		PrevOuts:       prevOuts,
+		Fee:            fee,
+		PackageFeeRate: float64(parent.Fee+fee) / float64(parent.VSize+vsize),
+		role:           role,
+	}, nil
+}
+
+// SignAnchor signs the keyed anchor input with key, the contract key of the
+// role the child was built for. An ephemeral anchor needs no signature.
+func (c *AnchorChild) SignAnchor(key *btcutil.WIF) error {
+	anchor := c.PrevOuts.FetchPrevOutput(c.Tx.TxIn[0].PreviousOutPoint)
+	if isPayToAnchor(anchor.PkScript) {
+		return nil
+	}
+	if key == nil {
+		return &ParamError{Field: "PrivateKey", Err: ErrMissingValue}
+	}
+
+	keyHash := btcutil.Hash160(key.PrivKey.PubKey().SerializeCompressed())
+	if !bytes.Equal(anchor.PkScript[2:], keyHash) {
+		return fmt.Errorf("%w: key does not match the anchor of %v", ErrSecretMismatch, c.role)
+	}
+
+	sigHashes := txscript.NewTxSigHashes(c.Tx, c.PrevOuts)
+	witness, err := txscript.WitnessSignature(c.Tx, sigHashes, 0, anchor.Value, anchor.PkScript,
+		txscript.SigHashAll, key.PrivKey, true)
+	if err != nil {
+		return err
+	}
+	c.Tx.TxIn[0].Witness = witness
+	return nil
+}
@@ -0,0 +1,100 @@
+package hehtlc
+
+import (
+	"errors"
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestAnchors(t *testing.T) {
+	for _, anchors := range []AnchorType{AnchorKeyed, AnchorEphemeral} {
+		t.Run(anchors.String(), func(t *testing.T) {
+			params := GenTestParams()
+			WithAnchors(anchors)(&params)
+			assert.NoError(t, params.DeriveCollateralUTXO())
+			assert.NoError(t, params.Validate())
+
+			outputs, err := anchorOutputs(&params)
+			assert.NoError(t, err)
+			for _, path := range setupPaths {
+				signed, err := signLocally(&params, path)
+				assert.NoError(t, err, path.String())
+				assert.Equal(t, outputs, signed.Tx.TxOut[len(signed.Tx.TxOut)-len(outputs):], path.String())
+			}
+
+			// the collateral covers Col-B with its anchors and fee
+			signed, err := signLocally(&params, PathCollateralBob)
+			assert.NoError(t, err)
+			assert.Equal(t, params.Terms.VDep+params.Terms.VCol, signed.Tx.TxOut[0].Value)
+			assert.Equal(t, params.Terms.Fee, signed.Fee)
+
+			// Bob bumps Dep-B with his anchor and a wallet UTXO
+			parent, err := signLocally(&params, PathDepositBob)
+			assert.NoError(t, err)
+			wallet, walletKey := testWalletInput(t, &params, 50000)
+			child, err := NewAnchorChild(&params, parent, RoleBob, wallet, 20, params.Bob2Bech32Address)
+			assert.NoError(t, err)
+			assert.GreaterOrEqual(t, child.PackageFeeRate, 20.0)
+			assert.Equal(t, parent.TxID, child.Tx.TxIn[0].PreviousOutPoint.Hash)
+
+			// the wrong key cannot sign a keyed anchor
+			if anchors == AnchorKeyed {
+				assert.True(t, errors.Is(child.SignAnchor(params.Alice.PrivateKey), ErrSecretMismatch))
+				assert.True(t, errors.Is(child.SignAnchor(nil), ErrMissingValue))
+			}
+			assert.NoError(t, child.SignAnchor(params.Bob.PrivateKey))
+			sigHashes := txscript.NewTxSigHashes(child.Tx, child.PrevOuts)
+			witness, err := txscript.WitnessSignature(child.Tx, sigHashes, 1, wallet.TxOut.Value,
+				wallet.TxOut.PkScript, txscript.SigHashAll, walletKey.PrivKey, true)
+			assert.NoError(t, err)
+			child.Tx.TxIn[1].Witness = witness
+			assert.NoError(t, VerifySpend(child.Tx, child.PrevOuts))
+
+			signedChild, err := newSignedSpend(parent.Path, child.Tx, 0)
+			assert.NoError(t, err)
+			packageRate := float64(parent.Fee+child.Fee) / float64(parent.VSize+signedChild.VSize)
+			assert.GreaterOrEqual(t, packageRate, 20.0)
+		})
+	}
+
+	t.Run("errors", func(t *testing.T) {
+		params := GenTestParams()
+		parent, err := signLocally(&params, PathDepositBob)
+		assert.NoError(t, err)
+		wallet, _ := testWalletInput(t, &params, 50000)
+		_, err = NewAnchorChild(&params, parent, RoleBob, wallet, 20, params.Bob2Bech32Address)
+		assert.True(t, errors.Is(err, ErrInvalidAnchor))
+
+		WithAnchors(AnchorKeyed)(&params)
+		_, err = NewAnchorChild(&params, parent, RoleBob, wallet, 20, params.Bob2Bech32Address)
+		assert.True(t, errors.Is(err, ErrInvalidAnchor))
+		assert.NoError(t, params.DeriveCollateralUTXO())
+
+		parent, err = signLocally(&params, PathDepositBob)
+		assert.NoError(t, err)
+		// Dep-B already pays most of a 300 sat/vB package
+		wallet, _ = testWalletInput(t, &params, 1000)
+		_, err = NewAnchorChild(&params, parent, RoleBob, wallet, 300, params.Bob2Bech32Address)
+		assert.True(t, errors.Is(err, ErrDustOutput))
+
+		params.Anchors = AnchorType(7)
+		assert.True(t, errors.Is(params.Validate(), ErrInvalidAnchor))
+	})
+}
+
+// testWalletInput returns a P2WPKH wallet UTXO worth amount and its key.
+func testWalletInput(t *testing.T, params *Parameters, amount int64) (*WalletInput, *btcutil.WIF) {
+	key := params.Alice.PrivateKey
+	addr, err := btcutil.NewAddressWitnessPubKeyHash(btcutil.Hash160(key.SerializePubKey()), params.Terms.Net)
+	assert.NoError(t, err)
+	pkScript, err := txscript.PayToAddrScript(addr)
+	assert.NoError(t, err)
+	return &WalletInput{
+		OutPoint: *wire.NewOutPoint(&chainhash.Hash{1}, 0),
+		TxOut:    wire.NewTxOut(amount, pkScript),
+	}, key
+}
@@ -0,0 +1,206 @@
+package hehtlc
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+)
+
+// ClassifiedInput is a transaction input spending a He-HTLC contract.
+type ClassifiedInput struct {
+	Index int
+	Path  SpendPath
+
+	// Script is the P2WSH witness script or the taproot leaf the input
+	// reveals.
+	Script  []byte
+	Taproot bool
+
+	// PreA and PreB are the preimages the witness reveals, if any.
+	PreA []byte
+	PreB []byte
+}
+
+// ClassifyTx classifies every input of tx that spends a He-HTLC contract,
+// reading the outputs it spends from prevOuts. Other inputs are left out.
+//
+// Taproot key-path spends reveal no script, so a cooperative close cannot be
+// told apart from any other single-key spend and is left out too.
+func ClassifyTx(tx *wire.MsgTx, prevOuts txscript.PrevOutputFetcher) ([]*ClassifiedInput, error) {
+	var classified []*ClassifiedInput
+	for i, txIn := range tx.TxIn {
+		prevOut := prevOuts.FetchPrevOutput(txIn.PreviousOutPoint)
+		if prevOut == nil {
+			return nil, fmt.Errorf("hehtlc: input %d: unknown prevout %v", i, txIn.PreviousOutPoint)
+		}
+
+		input, err := ClassifyInput(tx, i, prevOut)
+		if err != nil {
+			if errors.Is(err, ErrNotHeHTLC) {
+				continue
+			}
+			return nil, err
+		}
+		classified = append(classified, input)
+	}
+	return classified, nil
+}
+
+// ClassifyInput returns the spend path input idx of tx takes from prevOut,
+// telling the paths apart by the layout of the witness the spend functions
+// produce, and the preimages the witness reveals. An input that does not
+// spend a He-HTLC contract fails with ErrNotHeHTLC.
+func ClassifyInput(tx *wire.MsgTx, idx int, prevOut *wire.TxOut) (*ClassifiedInput, error) {
+	if idx < 0 || idx >= len(tx.TxIn) {
+		return nil, fmt.Errorf("hehtlc: input %d out of range", idx)
+	}
+
+	witness := tx.TxIn[idx].Witness
+	class := txscript.GetScriptClass(prevOut.PkScript)
+
+	var (
+		input *ClassifiedInput
+		err   error
+	)
+	switch class {
+	case txscript.WitnessV0ScriptHashTy:
+		input, err = classifyWitnessScriptHash(witness, prevOut.PkScript)
+	case txscript.WitnessV1TaprootTy:
+		input, err = classifyTapscript(witness, prevOut.PkScript)
+	default:
+		err = fmt.Errorf("%w: spends a %v output", ErrNotHeHTLC, class)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("hehtlc: input %d: %w", idx, err)
+	}
+
+	input.Index = idx
+	return input, nil
+}
+
+// classifyWitnessScriptHash classifies the witnesses of witness:
+//
+//	Dep-A  preA || <signatures> || script
+//	Dep-B  preB || dummy || <signatures> || script
+//	Col-B  dummy || <signatures> || script
+//	Col-M  preB || preA || <signatures> || script
+//
+// where the signatures are "" || sigA || sigB in the multisig form and
+// sigB || sigA otherwise. The miniscript encoding has no dummy and puts the
+// OP_IF branch, 1 for Dep-A and Col-B and empty for Dep-B and Col-M, between
+// the signatures and the script.
+func classifyWitnessScriptHash(witness wire.TxWitness, pkScript []byte) (*ClassifiedInput, error) {
+	if len(witness) == 0 {
+		return nil, fmt.Errorf("%w: empty witness", ErrNotHeHTLC)
+	}
+	script := witness[len(witness)-1]
+	scriptHash := sha256.Sum256(script)
+	if !bytes.Equal(pkScript[2:], scriptHash[:]) {
+		return nil, fmt.Errorf("%w: witness script does not match the prevout", ErrNotHeHTLC)
+	}
+
+	deposit, depositErr := ParseDepositContract(script)
+	collateral, collateralErr := ParseCollateralContract(script)
+	contract := deposit
+	if depositErr != nil {
+		if collateralErr != nil {
+			return nil, depositErr
+		}
+		contract = collateral
+	}
+
+	signatures := 2
+	if contract.ScriptForm == ScriptFormMultisig {
+		signatures = 3
+	}
+	if len(witness) < signatures+1 {
+		return nil, fmt.Errorf("%w: witness has %d elements", ErrNotHeHTLC, len(witness))
+	}
+	inputs := witness[:len(witness)-signatures-1]
+	if contract.Miniscript {
+		if len(inputs) == 0 {
+			return nil, fmt.Errorf("%w: witness has %d elements", ErrNotHeHTLC, len(witness))
+		}
+		branch := witness[len(witness)-2]
+		first := bytes.Equal(branch, []byte{0x01})
+		if !first && len(branch) != 0 {
+			return nil, fmt.Errorf("%w: branch selector %x is not minimal", ErrNotHeHTLC, branch)
+		}
+		// the layout is the one above once the branch takes the place of
+		// the dummy of Dep-B and Col-B
+		inputs = witness[:len(witness)-signatures-2]
+		if (deposit != nil) != first {
+			inputs = append(inputs[:len(inputs):len(inputs)], branch)
+		}
+	}
+
+	input := &ClassifiedInput{Script: script}
+	switch {
+	case deposit != nil && len(inputs) == 1 && deposit.HashFunc.matches(inputs[0], deposit.HashA):
+		input.Path = PathDepositAlice
+		input.PreA = inputs[0]
+	case deposit != nil && len(inputs) == 2 && deposit.HashFunc.matches(inputs[0], deposit.HashB):
+		input.Path = PathDepositBob
+		input.PreB = inputs[0]
+	case collateral != nil && len(inputs) == 1 && !collateral.HashFunc.matches(inputs[0], collateral.HashA):
+		input.Path = PathCollateralBob
+	case collateral != nil && len(inputs) == 2 &&
+		collateral.HashFunc.matches(inputs[0], collateral.HashB) &&
+		collateral.HashFunc.matches(inputs[1], collateral.HashA):
+
+		input.Path = PathCollateralMiner
+		input.PreB, input.PreA = inputs[0], inputs[1]
+	default:
+		return nil, fmt.Errorf("%w: witness satisfies no spend path", ErrNotHeHTLC)
+	}
+	return input, nil
+}
+
+// classifyTapscript classifies a script-path spend of a taproot contract:
+// the leaf script is the path, and the inputs below sigB || sigA are the
+// preimages it needs.
+func classifyTapscript(witness wire.TxWitness, pkScript []byte) (*ClassifiedInput, error) {
+	// BIP-341: a last element starting with 0x50 is the annex
+	if len(witness) >= 2 && len(witness[len(witness)-1]) > 0 &&
+		witness[len(witness)-1][0] == txscript.TaprootAnnexTag {
+
+		witness = witness[:len(witness)-1]
+	}
+	if len(witness) < 4 {
+		return nil, fmt.Errorf("%w: not a script-path spend", ErrNotHeHTLC)
+	}
+
+	script, controlBlockBytes := witness[len(witness)-2], witness[len(witness)-1]
+	controlBlock, err := txscript.ParseControlBlock(controlBlockBytes)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrNotHeHTLC, err)
+	}
+	if err := txscript.VerifyTaprootLeafCommitment(controlBlock, pkScript[2:], script); err != nil {
+		return nil, fmt.Errorf("%w: leaf does not match the prevout: %v", ErrNotHeHTLC, err)
+	}
+
+	path, terms, err := parseTaprootLeaf(script)
+	if err != nil {
+		return nil, err
+	}
+
+	inputs := witness[:len(witness)-4]
+	input := &ClassifiedInput{Path: path, Script: script, Taproot: true}
+	switch {
+	case path == PathDepositAlice && len(inputs) == 1 && terms.HashFunc.matches(inputs[0], terms.HashA):
+		input.PreA = inputs[0]
+	case path == PathDepositBob && len(inputs) == 1 && terms.HashFunc.matches(inputs[0], terms.HashB):
+		input.PreB = inputs[0]
+	case path == PathCollateralBob && len(inputs) == 0:
+	case path == PathCollateralMiner && len(inputs) == 2 &&
+		terms.HashFunc.matches(inputs[0], terms.HashB) && terms.HashFunc.matches(inputs[1], terms.HashA):
+
+		input.PreB, input.PreA = inputs[0], inputs[1]
+	default:
+		return nil, fmt.Errorf("%w: witness does not satisfy the %v leaf", ErrNotHeHTLC, path)
+	}
+	return input, nil
+}
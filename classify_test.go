@@ -0,0 +1,85 @@
+package hehtlc
+
+import (
+	"errors"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestClassifyTx(t *testing.T) {
+	configs := []struct {
+		name string
+		set  func(*Parameters)
+	}{
+		{"multisig", func(*Parameters) {}},
+		{"checksig", WithScriptForm(ScriptFormCheckSig)},
+		{"miniscript", WithMiniscript()},
+		{"taproot", func(params *Parameters) { *params = genTaprootTestParams(nil) }},
+		{"taproot checksigadd", func(params *Parameters) {
+			*params = genTaprootTestParams(nil)
+			params.Terms.ScriptForm = ScriptFormCheckSigAdd
+		}},
+	}
+	for _, config := range configs {
+		params := GenTestParams()
+		config.set(&params)
+
+		for _, path := range setupPaths {
+			t.Run(config.name+"/"+path.String(), func(t *testing.T) {
+				signed, err := signLocally(&params, path)
+				assert.NoError(t, err)
+				unsigned, err := NewUnsignedSpend(&params, path)
+				assert.NoError(t, err)
+				prevOut := wire.NewTxOut(unsigned.Amount, unsigned.PkScript)
+				prevOuts := txscript.NewCannedPrevOutputFetcher(prevOut.PkScript, prevOut.Value)
+
+				classified, err := ClassifyTx(signed.Tx, prevOuts)
+				assert.NoError(t, err)
+				if !assert.Len(t, classified, 1) {
+					return
+				}
+				input := classified[0]
+				assert.Equal(t, path, input.Path)
+				assert.Equal(t, params.Terms.Taproot, input.Taproot)
+				assert.Equal(t, unsigned.WitnessScript, input.Script)
+
+				switch path {
+				case PathDepositAlice:
+					assert.Equal(t, params.Alice.PreA, input.PreA)
+					assert.Nil(t, input.PreB)
+				case PathDepositBob:
+					assert.Nil(t, input.PreA)
+					assert.Equal(t, params.Bob.PreB, input.PreB)
+				case PathCollateralBob:
+					assert.Nil(t, input.PreA)
+					assert.Nil(t, input.PreB)
+				case PathCollateralMiner:
+					assert.Equal(t, params.Alice.PreA, input.PreA)
+					assert.Equal(t, params.Bob.PreB, input.PreB)
+				}
+
+				// a wrong preimage satisfies no path; Col-B reveals none
+				if path != PathCollateralBob {
+					tx := signed.Tx.Copy()
+					tx.TxIn[0].Witness[0] = []byte{0x01}
+					_, err = ClassifyInput(tx, 0, prevOut)
+					assert.True(t, errors.Is(err, ErrNotHeHTLC), "%v", err)
+				}
+			})
+		}
+	}
+
+	t.Run("other inputs", func(t *testing.T) {
+		params := GenTestParams()
+		signed, err := signLocally(&params, PathDepositAlice)
+		assert.NoError(t, err)
+
+		// a P2WPKH prevout
+		prevOuts := txscript.NewCannedPrevOutputFetcher(append([]byte{0x00, 0x14}, params.Terms.HashA...), 1000)
+		classified, err := ClassifyTx(signed.Tx, prevOuts)
+		assert.NoError(t, err)
+		assert.Empty(t, classified)
+	})
+}
@@ -0,0 +1,193 @@
+package hehtlc
+
+import (
+	"fmt"
+	"github.com/btcsuite/btcd/btcec/v2/schnorr"
+	"strings"
+)
+
+// DepositPolicy returns the spending policy of the deposit in the policy
+// language of the miniscript compilers: both signatures, and either preA or
+// preB after T.
+func DepositPolicy(terms *ContractTerms) (string, error) {
+	if err := terms.Validate(); err != nil {
+		return "", err
+	}
+
+	pkA, pkB := terms.GetAliceBobPks()
+	hash := terms.HashFunc
+	return fmt.Sprintf("and(pk(%x),and(pk(%x),or(%v(%x),and(%s,%v(%x)))))",
+		pkA, pkB, hash, terms.HashA, miniscriptTimelock(terms.encodedT(), terms.TMode), hash, terms.HashB), nil
+}
+
+// CollateralPolicy returns the spending policy of the collateral: both
+// signatures, and either preA and preB together or ell.
+func CollateralPolicy(terms *ContractTerms) (string, error) {
+	if err := terms.Validate(); err != nil {
+		return "", err
+	}
+
+	pkA, pkB := terms.GetAliceBobPks()
+	hash := terms.HashFunc
+	return fmt.Sprintf("and(pk(%x),and(pk(%x),or(and(%v(%x),%v(%x)),%s)))",
+		pkA, pkB, hash, terms.HashA, hash, terms.HashB, miniscriptTimelock(terms.encodedEll(), terms.EllMode)), nil
+}
+
+// DepositDescriptor returns the output descriptor of the deposit, wsh(...)
+// or tr(...), with its checksum. terms must use the miniscript encoding.
+func DepositDescriptor(terms *ContractTerms) (string, error) {
+	if err := checkMiniscript(terms); err != nil {
+		return "", err
+	}
+
+	hashA := fmt.Sprintf("%v(%x)", terms.HashFunc, terms.HashA)
+	hashB := fmt.Sprintf("%v(%x)", terms.HashFunc, terms.HashB)
+	timelock := miniscriptTimelock(terms.encodedT(), terms.TMode)
+
+	return contractDescriptor(terms,
+		miniscriptSignatures(terms, hashA),
+		miniscriptSignatures(terms, fmt.Sprintf("and_v(v:%s,%s)", timelock, hashB)))
+}
+
+// CollateralDescriptor returns the output descriptor of the collateral,
+// wsh(...) or tr(...), with its checksum. terms must use the miniscript
+// encoding.
+func CollateralDescriptor(terms *ContractTerms) (string, error) {
+	if err := checkMiniscript(terms); err != nil {
+		return "", err
+	}
+
+	hashA := fmt.Sprintf("%v(%x)", terms.HashFunc, terms.HashA)
+	hashB := fmt.Sprintf("%v(%x)", terms.HashFunc, terms.HashB)
+	timelock := miniscriptTimelock(terms.encodedEll(), terms.EllMode)
+
+	return contractDescriptor(terms,
+		miniscriptSignatures(terms, timelock),
+		miniscriptSignatures(terms, fmt.Sprintf("and_v(v:%s,%s)", hashA, hashB)))
+}
+
+// contractDescriptor returns the descriptor of a contract with the two
+// spend paths first and second: the leaves of a taproot contract, or the
+// or_i branches of a P2WSH one. Each branch checks both signatures itself,
+// which keeps the miniscript non-malleable.
+func contractDescriptor(terms *ContractTerms, first, second string) (string, error) {
+	if terms.Taproot {
+		return taprootDescriptor(terms, first, second)
+	}
+	return withChecksum(fmt.Sprintf("wsh(or_i(%s,%s))", first, second))
+}
+
+func checkMiniscript(terms *ContractTerms) error {
+	if err := terms.Validate(); err != nil {
+		return err
+	}
+	if !terms.Miniscript {
+		return paramErrorf("Miniscript", ErrNotMiniscript,
+			"hash locks without a size check cannot be expressed, use the miniscript encoding")
+	}
+	return nil
+}
+
+// miniscriptTimelock returns older() for a relative timelock and after() for
+// an absolute one. Both take value as encodeTimelock encodes it.
+func miniscriptTimelock(value int64, mode TimelockMode) string {
+	if mode == TimelockAbsolute {
+		return fmt.Sprintf("after(%d)", value)
+	}
+	return fmt.Sprintf("older(%d)", value)
+}
+
+// miniscriptSignatures prefixes inner with the signature check of the script
+// form of terms.
+func miniscriptSignatures(terms *ContractTerms, inner string) string {
+	pkA, pkB := terms.GetAliceBobPks()
+	if terms.Taproot {
+		pkA, pkB = schnorr.SerializePubKey(terms.AlicePubKey), schnorr.SerializePubKey(terms.BobPubKey)
+	}
+
+	switch terms.signatureForm() {
+	case ScriptFormMultisig:
+		return fmt.Sprintf("and_v(v:multi(2,%x,%x),%s)", pkA, pkB, inner)
+	case ScriptFormCheckSigAdd:
+		return fmt.Sprintf("and_v(v:multi_a(2,%x,%x),%s)", pkA, pkB, inner)
+	default:
+		return fmt.Sprintf("and_v(v:pk(%x),and_v(v:pk(%x),%s))", pkA, pkB, inner)
+	}
+}
+
+// taprootDescriptor returns tr() of the internal key of terms with the two
+// leaves of a contract.
+func taprootDescriptor(terms *ContractTerms, leaf0, leaf1 string) (string, error) {
+	internalKey, err := terms.TaprootInternalKey()
+	if err != nil {
+		return "", err
+	}
+	return withChecksum(fmt.Sprintf("tr(%x,{%s,%s})", schnorr.SerializePubKey(internalKey), leaf0, leaf1))
+}
+
+func withChecksum(desc string) (string, error) {
+	checksum, err := DescriptorChecksum(desc)
+	if err != nil {
+		return "", err
+	}
+	return desc + "#" + checksum, nil
+}
+
+// Character sets and generator of the BIP-380 descriptor checksum.
+const (
+	descriptorInputCharset    = "0123456789()[],'/*abcdefgh@:$%{}IJKLMNOPQRSTUVWXYZ&+-.;<=>?!^_|~ijklmnopqrstuvwxyzABCDEFGH`#\"\\ "
+	descriptorChecksumCharset = "qpzry9x8gf2tvdw0s3jn54khce6mua7l"
+)
+
+var descriptorGenerator = [5]uint64{0xf5dee51989, 0xa9fdca3312, 0x1bab10e32d, 0x3706b1677a, 0x644d626ffd}
+
+// DescriptorChecksum returns the 8-character BIP-380 checksum of desc, which
+// must not carry one already.
+// https://github.com/bitcoin/bips/blob/master/bip-0380.mediawiki
+func DescriptorChecksum(desc string) (string, error) {
+	var (
+		symbols []uint64
+		groups  []uint64
+	)
+	for _, c := range desc {
+		v := strings.IndexRune(descriptorInputCharset, c)
+		if v < 0 {
+			return "", fmt.Errorf("hehtlc: invalid descriptor character %q", c)
+		}
+		symbols = append(symbols, uint64(v&31))
+		groups = append(groups, uint64(v>>5))
+		if len(groups) == 3 {
+			symbols = append(symbols, groups[0]*9+groups[1]*3+groups[2])
+			groups = groups[:0]
+		}
+	}
+	switch len(groups) {
+	case 1:
+		symbols = append(symbols, groups[0])
+	case 2:
+		symbols = append(symbols, groups[0]*3+groups[1])
+	}
+	symbols = append(symbols, 0, 0, 0, 0, 0, 0, 0, 0)
+
+	checksum := descriptorPolymod(symbols) ^ 1
+
+	var out [8]byte
+	for i := range out {
+		out[i] = descriptorChecksumCharset[(checksum>>(5*(7-uint(i))))&31]
+	}
+	return string(out[:]), nil
+}
+
+func descriptorPolymod(symbols []uint64) uint64 {
+	chk := uint64(1)
+	for _, value := range symbols {
+		top := chk >> 35
+		chk = (chk&0x7ffffffff)<<5 ^ value
+		for i, generator := range descriptorGenerator {
+			if (top>>uint(i))&1 == 1 {
+				chk ^= generator
+			}
+		}
+	}
+	return chk
+}
@@ -0,0 +1,259 @@
+package hehtlc
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/stretchr/testify/assert"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestDescriptorChecksum(t *testing.T) {
+	vectors := []struct {
+		desc     string
+		checksum string
+	}{
+		{"raw(deadbeef)", "89f8spxm"},
+		{"addr(mkmZxiEcEd8ZqjQWVZuC6so5dFMKEFpN2j)", "02wpgw69"},
+	}
+	for _, v := range vectors {
+		checksum, err := DescriptorChecksum(v.desc)
+		assert.NoError(t, err)
+		assert.Equal(t, v.checksum, checksum)
+	}
+
+	_, err := DescriptorChecksum("raw(deadbeef)\n")
+	assert.Error(t, err)
+}
+
+func TestDescriptors(t *testing.T) {
+	cases := []struct {
+		name     string
+		taproot  bool
+		form     ScriptForm
+		hashFunc HashFunc
+		mode     TimelockMode
+	}{
+		{"wsh multisig", false, ScriptFormMultisig, HashFuncHash160, TimelockRelative},
+		{"wsh checksig", false, ScriptFormCheckSig, HashFuncHash160, TimelockRelative},
+		{"wsh sha256", false, ScriptFormMultisig, HashFuncSHA256, TimelockRelative},
+		{"wsh absolute", false, ScriptFormMultisig, HashFuncHash160, TimelockAbsolute},
+		{"tr checksig", true, ScriptFormCheckSig, HashFuncHash160, TimelockRelative},
+		{"tr checksigadd", true, ScriptFormCheckSigAdd, HashFuncHash160, TimelockRelative},
+		{"tr hash256", true, ScriptFormCheckSig, HashFuncHash256, TimelockRelative},
+		{"tr absolute", true, ScriptFormCheckSig, HashFuncHash160, TimelockAbsolute},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			params := GenTestParams()
+			if c.taproot {
+				params = genTaprootTestParams(nil)
+			}
+			WithScriptForm(c.form)(&params)
+			WithMiniscript()(&params)
+			terms := &params.Terms
+			terms.HashFunc = c.hashFunc
+			terms.HashA = c.hashFunc.Sum(params.Alice.PreA)
+			terms.HashB = c.hashFunc.Sum(params.Bob.PreB)
+			if c.mode == TimelockAbsolute {
+				terms.T, terms.TMode = 2500000, TimelockAbsolute
+				terms.Ell, terms.EllMode = 2500144, TimelockAbsolute
+			}
+
+			deposit, err := DepositDescriptor(terms)
+			assert.NoError(t, err)
+			collateral, err := CollateralDescriptor(terms)
+			assert.NoError(t, err)
+
+			if c.taproot {
+				depositContract, err := BuildTaprootDepositContract(terms)
+				assert.NoError(t, err)
+				collateralContract, err := BuildTaprootCollateralContract(terms)
+				assert.NoError(t, err)
+				assertTaprootDescriptor(t, deposit, depositContract, PathDepositAlice, PathDepositBob)
+				assertTaprootDescriptor(t, collateral, collateralContract, PathCollateralBob, PathCollateralMiner)
+			} else {
+				depositScript, _, err := BuildDepositContract(terms)
+				assert.NoError(t, err)
+				collateralScript, _, err := BuildCollateralContract(terms)
+				assert.NoError(t, err)
+				assert.Equal(t, depositScript, compileDescriptor(t, deposit, "wsh("))
+				assert.Equal(t, collateralScript, compileDescriptor(t, collateral, "wsh("))
+			}
+
+			// the miniscript encoding spends like the original one
+			for _, path := range setupPaths {
+				_, err := signLocally(&params, path)
+				assert.NoError(t, err, path.String())
+			}
+		})
+	}
+
+	t.Run("policies", func(t *testing.T) {
+		params := GenTestParams()
+		policy, err := DepositPolicy(&params.Terms)
+		assert.NoError(t, err)
+		assert.True(t, strings.HasPrefix(policy, "and(pk("))
+		assert.Contains(t, policy, fmt.Sprintf("and(older(%d),hash160(%x))", params.Terms.T, params.Terms.HashB))
+
+		policy, err = CollateralPolicy(&params.Terms)
+		assert.NoError(t, err)
+		assert.Contains(t, policy, fmt.Sprintf("older(%d))))", params.Terms.Ell))
+	})
+
+	t.Run("not miniscript", func(t *testing.T) {
+		params := GenTestParams()
+		_, err := DepositDescriptor(&params.Terms)
+		assert.True(t, errors.Is(err, ErrNotMiniscript))
+		_, err = CollateralDescriptor(&params.Terms)
+		assert.True(t, errors.Is(err, ErrNotMiniscript))
+	})
+}
+
+// assertTaprootDescriptor checks the internal key and both leaves of a tr()
+// descriptor against contract.
+func assertTaprootDescriptor(t *testing.T, desc string, contract *TaprootContract, paths ...SpendPath) {
+	body := checkDescriptor(t, desc, "tr(")
+	args := splitArgs(body)
+	assert.Len(t, args, 2)
+	assert.Equal(t, fmt.Sprintf("%x", contract.InternalKey.SerializeCompressed()[1:]), args[0])
+
+	leaves := splitArgs(strings.TrimSuffix(strings.TrimPrefix(args[1], "{"), "}"))
+	assert.Len(t, leaves, len(paths))
+	for i, path := range paths {
+		leafScript, _, err := contract.LeafScript(path)
+		assert.NoError(t, err)
+		assert.Equal(t, leafScript, compileMiniscript(t, leaves[i], false), path.String())
+	}
+}
+
+// compileDescriptor checks the checksum of desc and compiles its miniscript.
+func compileDescriptor(t *testing.T, desc, prefix string) []byte {
+	return compileMiniscript(t, checkDescriptor(t, desc, prefix), false)
+}
+
+func checkDescriptor(t *testing.T, desc, prefix string) string {
+	i := strings.LastIndex(desc, "#")
+	checksum, err := DescriptorChecksum(desc[:i])
+	assert.NoError(t, err)
+	assert.Equal(t, checksum, desc[i+1:])
+
+	assert.True(t, strings.HasPrefix(desc, prefix))
+	return strings.TrimSuffix(strings.TrimPrefix(desc[:i], prefix), ")")
+}
+
+// compileMiniscript compiles the fragments the descriptors use to script, the
+// way the miniscript specification translates them.
+func compileMiniscript(t *testing.T, ms string, verify bool) []byte {
+	if strings.HasPrefix(ms, "v:") {
+		return compileMiniscript(t, ms[2:], true)
+	}
+
+	open := strings.Index(ms, "(")
+	name, args := ms[:open], splitArgs(ms[open+1:len(ms)-1])
+	builder := txscript.NewScriptBuilder()
+	addVerify := func(op, verifyOp byte) {
+		if verify {
+			builder.AddOp(verifyOp)
+		} else {
+			builder.AddOp(op)
+		}
+	}
+	raw := func(b []byte) { builder.AddOps(b) }
+	data := func(s string) []byte {
+		b, err := hex.DecodeString(s)
+		assert.NoError(t, err)
+		return b
+	}
+	number := func(s string) int64 {
+		n, err := strconv.ParseInt(s, 10, 64)
+		assert.NoError(t, err)
+		return n
+	}
+
+	switch name {
+	case "pk":
+		builder.AddData(data(args[0]))
+		addVerify(txscript.OP_CHECKSIG, txscript.OP_CHECKSIGVERIFY)
+	case "multi":
+		builder.AddInt64(number(args[0]))
+		for _, key := range args[1:] {
+			builder.AddData(data(key))
+		}
+		builder.AddInt64(int64(len(args) - 1))
+		addVerify(txscript.OP_CHECKMULTISIG, txscript.OP_CHECKMULTISIGVERIFY)
+	case "multi_a":
+		for i, key := range args[1:] {
+			builder.AddData(data(key))
+			if i == 0 {
+				builder.AddOp(txscript.OP_CHECKSIG)
+			} else {
+				builder.AddOp(txscript.OP_CHECKSIGADD)
+			}
+		}
+		builder.AddInt64(number(args[0]))
+		addVerify(txscript.OP_NUMEQUAL, txscript.OP_NUMEQUALVERIFY)
+	case "hash160", "sha256", "hash256":
+		hashOps := map[string]byte{
+			"hash160": txscript.OP_HASH160,
+			"sha256":  txscript.OP_SHA256,
+			"hash256": txscript.OP_HASH256,
+		}
+		builder.AddOp(txscript.OP_SIZE).AddInt64(32).AddOp(txscript.OP_EQUALVERIFY)
+		builder.AddOp(hashOps[name]).AddData(data(args[0]))
+		addVerify(txscript.OP_EQUAL, txscript.OP_EQUALVERIFY)
+	case "older", "after":
+		if name == "older" {
+			builder.AddInt64(number(args[0])).AddOp(txscript.OP_CHECKSEQUENCEVERIFY)
+		} else {
+			builder.AddInt64(number(args[0])).AddOp(txscript.OP_CHECKLOCKTIMEVERIFY)
+		}
+		if verify {
+			builder.AddOp(txscript.OP_VERIFY)
+		}
+	case "and_v":
+		raw(compileMiniscript(t, args[0], false))
+		raw(compileMiniscript(t, args[1], verify))
+	case "or_i":
+		builder.AddOp(txscript.OP_IF)
+		raw(compileMiniscript(t, args[0], false))
+		builder.AddOp(txscript.OP_ELSE)
+		raw(compileMiniscript(t, args[1], false))
+		builder.AddOp(txscript.OP_ENDIF)
+		if verify {
+			builder.AddOp(txscript.OP_VERIFY)
+		}
+	default:
+		t.Fatalf("unexpected fragment %s", name)
+	}
+
+	script, err := builder.Script()
+	assert.NoError(t, err)
+	return script
+}
+
+// splitArgs splits s at the commas outside any parentheses or braces.
+func splitArgs(s string) []string {
+	var (
+		args  []string
+		depth int
+		start int
+	)
+	for i, c := range s {
+		switch c {
+		case '(', '{':
+			depth++
+		case ')', '}':
+			depth--
+		case ',':
+			if depth == 0 {
+				args = append(args, s[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(args, s[start:])
+}
@@ -0,0 +1,121 @@
+package hehtlc
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	// ErrMissingValue is returned when a required parameter was not supplied.
+	ErrMissingValue = errors.New("missing required value")
+
+	// ErrNonPositiveAmount is returned when vdep, vcol or fee is zero or
+	// negative.
+	ErrNonPositiveAmount = errors.New("amount must be positive")
+
+	// ErrTimelockOutOfRange is returned when T or ell cannot be encoded as a
+	// BIP68 relative lock-time or, in absolute mode, as a BIP65 lock time
+	// height or Unix time.
+	ErrTimelockOutOfRange = errors.New("timelock out of range")
+
+	// ErrAmountMismatch is returned when an input amount does not cover the
+	// outputs that spend it.
+	ErrAmountMismatch = errors.New("amount mismatch")
+
+	// ErrBadOutpoint is returned when a funding outpoint cannot be parsed.
+	ErrBadOutpoint = errors.New("bad outpoint")
+
+	// ErrInvalidAddress is returned when a payout address cannot be decoded.
+	ErrInvalidAddress = errors.New("invalid address")
+
+	// ErrWrongNetwork is returned when an address belongs to a different
+	// network than the contract.
+	ErrWrongNetwork = errors.New("wrong network")
+
+	// ErrInvalidHashLock is returned when a hash lock has the wrong length.
+	ErrInvalidHashLock = errors.New("invalid hash lock")
+
+	// ErrSecretMismatch is returned when a private key or preimage does not
+	// match the public key or hash lock of the contract terms.
+	ErrSecretMismatch = errors.New("secret does not match contract terms")
+
+	// ErrMissingSecret is returned when a signing key or preimage needed by a
+	// spend path was not supplied.
+	ErrMissingSecret = errors.New("missing secret")
+
+	// ErrInvalidSignature is returned when a counterparty signature does not
+	// verify against the sighash and witness script of a spend.
+	ErrInvalidSignature = errors.New("invalid signature")
+
+	// ErrMissingSignature is returned when a witness is requested before both
+	// signatures are present.
+	ErrMissingSignature = errors.New("missing signature")
+
+	// ErrInvalidPSBT is returned when a PSBT does not describe a He-HTLC
+	// spend of the given contract terms.
+	ErrInvalidPSBT = errors.New("invalid PSBT")
+
+	// ErrInvalidBundle is returned when a presigned bundle does not match the
+	// transaction tree of the contract.
+	ErrInvalidBundle = errors.New("invalid presigned bundle")
+
+	// ErrScriptVerify is returned when a transaction fails script
+	// verification against the outputs it spends.
+	ErrScriptVerify = errors.New("script verification failed")
+
+	// ErrInvalidScriptForm is returned when a script form cannot be used by
+	// the contract type, such as OP_CHECKMULTISIG in tapscript.
+	ErrInvalidScriptForm = errors.New("invalid script form")
+
+	// ErrNotMiniscript is returned when a descriptor is requested for a
+	// contract that is not in its miniscript-compatible encoding.
+	ErrNotMiniscript = errors.New("contract is not miniscript")
+
+	// ErrNotHeHTLC is returned when a script does not follow the deposit or
+	// collateral template.
+	ErrNotHeHTLC = errors.New("not a He-HTLC script")
+
+	// ErrTermsMismatch is returned when a He-HTLC script commits to other
+	// terms than the agreed ones.
+	ErrTermsMismatch = errors.New("script does not match contract terms")
+
+	// ErrDustOutput is returned when paying the fee would leave an output
+	// below the dust threshold.
+	ErrDustOutput = errors.New("output below dust threshold")
+
+	// ErrAbsurdFee is returned when the fee of a spend is above the cap set
+	// by MaxFee.
+	ErrAbsurdFee = errors.New("absurdly high fee")
+
+	// ErrInvalidAnchor is returned when an anchor type is unknown or a
+	// transaction has no anchor to bump its fee with.
+	ErrInvalidAnchor = errors.New("invalid anchor")
+
+	// ErrInvalidSigHash is returned when a spend path cannot be signed with
+	// the sighash type the terms ask for.
+	ErrInvalidSigHash = errors.New("invalid sighash type")
+)
+
+// ParamError reports which parameter failed validation and why. The
+// underlying reason is one of the Err* values above and can be matched with
+// errors.Is.
+type ParamError struct {
+	Field string
+	Err   error
+	Msg   string
+}
+
+func (e *ParamError) Error() string {
+	if e.Msg == "" {
+		return fmt.Sprintf("hehtlc: %s: %v", e.Field, e.Err)
+	}
+	return fmt.Sprintf("hehtlc: %s: %v: %s", e.Field, e.Err, e.Msg)
+}
+
+func (e *ParamError) Unwrap() error {
+	return e.Err
+}
+
+func paramErrorf(field string, err error, format string, args ...interface{}) *ParamError {
+	return &ParamError{Field: field, Err: err, Msg: fmt.Sprintf(format, args...)}
+}
@@ -0,0 +1,240 @@
+package hehtlc
+
+import (
+	"fmt"
+	"github.com/btcsuite/btcd/blockchain"
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/mempool"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"math"
+)
+
+// DefaultMaxFee is the fee cap when MaxFee is not set, Bitcoin Core's
+// default -maxtxfee of 0.1 BTC.
+const DefaultMaxFee = btcutil.SatoshiPerBitcoin / 10
+
+// EstimateVSize returns the virtual size of tx once its only input spends
+// path under terms, estimating the witness like EstimateWitnessSize.
+func EstimateVSize(terms *ContractTerms, path SpendPath, tx *wire.MsgTx) (int64, error) {
+	witnessSize, err := EstimateWitnessSize(terms, path)
+	if err != nil {
+		return 0, err
+	}
+
+	// the segwit marker and flag weigh one unit each
+	weight := int64(tx.SerializeSizeStripped()*blockchain.WitnessScaleFactor + 2 + witnessSize)
+	return (weight + blockchain.WitnessScaleFactor - 1) / blockchain.WitnessScaleFactor, nil
+}
+
+// noSpender is the spender of balanceSpend for a spend with no output of
+// the party spending it to take its fee from.
+const noSpender = -1
+
+// balanceSpend makes tx, a spend of path from inputs worth amount, pay its
+// fee and account for every other satoshi. The fee is params.FeeRate times
+// the estimated size of tx, or the Fee of the terms when no rate is set;
+// Col-M always pays vcol and the Fee the collateral reserves for it.
+// Whatever is left goes to ChangeAddress when set and above dust; otherwise
+// a rate-based fee comes out of the output at index spender, if any, while
+// any other surplus may only go to the miner up to an explicit MaxFee.
+func balanceSpend(params *Parameters, path SpendPath, tx *wire.MsgTx, amount int64, spender int) error {
+	maxFee := params.MaxFee
+	if maxFee == 0 {
+		maxFee = DefaultMaxFee
+	}
+
+	var change *wire.TxOut
+	if params.ChangeAddress != "" {
+		changeAddr, err := decodeAddress(params.ChangeAddress, params.Terms.Net)
+		if err != nil {
+			return &ParamError{Field: "ChangeAddress", Err: err}
+		}
+		changePkScript, err := txscript.PayToAddrScript(changeAddr)
+		if err != nil {
+			return err
+		}
+		change = wire.NewTxOut(0, changePkScript)
+		tx.AddTxOut(change)
+	}
+
+	// the fee of tx as it stands and what is left once it is paid
+	balance := func() (fee, surplus int64, err error) {
+		fee = params.Terms.Fee
+		switch {
+		case path == PathCollateralMiner:
+			// burning vdep is the penalty, vcol is the miner's reward
+			fee += params.Terms.VCol
+		case params.FeeRate > 0:
+			vsize, err := EstimateVSize(&params.Terms, path, tx)
+			if err != nil {
+				return 0, 0, err
+			}
+			fee = int64(math.Ceil(params.FeeRate * float64(vsize)))
+		}
+		if fee > maxFee {
+			return 0, 0, paramErrorf("FeeRate", ErrAbsurdFee, "%v fee %d above %d", path, fee, maxFee)
+		}
+
+		surplus = amount - fee
+		for _, txOut := range tx.TxOut {
+			surplus -= txOut.Value
+		}
+		return fee, surplus, nil
+	}
+
+	fee, surplus, err := balance()
+	if err != nil {
+		return err
+	}
+
+	if change != nil {
+		change.Value = surplus
+		if surplus > 0 && !mempool.IsDust(change, mempool.DefaultMinRelayTxFee) {
+			return nil
+		}
+		// no change output is worth creating, and a rate-based fee no
+		// longer pays for one
+		tx.TxOut = tx.TxOut[:len(tx.TxOut)-1]
+		if fee, surplus, err = balance(); err != nil {
+			return err
+		}
+		if surplus > 0 && (params.FeeRate == 0 || spender == noSpender) {
+			// dust no output takes back goes to the miner
+			fee, surplus = fee+surplus, 0
+		}
+	}
+
+	switch {
+	case params.FeeRate > 0 && spender != noSpender:
+		txOut := tx.TxOut[spender]
+		txOut.Value += surplus
+		if txOut.Value <= 0 || mempool.IsDust(txOut, mempool.DefaultMinRelayTxFee) {
+			return paramErrorf("FeeRate", ErrDustOutput, "%v fee %d leaves %d to output %d",
+				path, fee, txOut.Value, spender)
+		}
+	case surplus < 0:
+		return paramErrorf("Fee", ErrAmountMismatch, "%v input %d < outputs %d + fee %d",
+			path, amount, amount-fee-surplus, fee)
+	case surplus > 0 && (params.MaxFee == 0 || fee+surplus > params.MaxFee):
+		return paramErrorf("ChangeAddress", ErrAmountMismatch,
+			"%v would pay %d on top of fee %d to the miner, set a change address or a MaxFee covering it",
+			path, surplus, fee)
+	}
+	return nil
+}
+
+// FeeInputSpend is a signed spend with fee inputs attached at broadcast time.
+// Input 0 and output 0 are those of the spend, followed by the fee inputs and
+// a change output.
+type FeeInputSpend struct {
+	Tx *wire.MsgTx
+
+	// PrevOuts are the outputs every input spends, for signing the fee
+	// inputs and verifying the result.
+	PrevOuts *txscript.MultiPrevOutFetcher
+
+	// Fee is what the transaction pays and FeeRate its estimated feerate
+	// once the fee inputs are signed.
+	Fee     int64
+	FeeRate float64
+}
+
+// AddFeeInputs attaches inputs to signed, a spend whose signatures are
+// SIGHASH_SINGLE|ANYONECANPAY, with a change output to changeAddr so the
+// transaction pays feeRate sat/vB. Those signatures only commit to the
+// contract input and the output at its index, so they stay valid, which is
+// checked before returning. The fee inputs are left for the caller to sign.
+// Dep-B is refused, since Col-B and Col-M are presigned against its txid.
+func AddFeeInputs(params *Parameters, signed *SignedSpend, inputs []*WalletInput, feeRate float64,
+	changeAddr string) (*FeeInputSpend, error) {
+
+	terms := &params.Terms
+	if signed.Path == PathDepositBob {
+		// new inputs change the txid and orphan the presigned Col-B and Col-M
+		return nil, paramErrorf("SigHashes", ErrInvalidSigHash,
+			"%v is spent by presigned transactions", signed.Path)
+	}
+	if hashType := terms.sigHashType(signed.Path); hashType != sigHashSingleAnyoneCanPay {
+		return nil, paramErrorf("SigHashes", ErrInvalidSigHash,
+			"%v is signed with %v, which commits to its inputs", signed.Path, hashType)
+	}
+	if feeRate <= 0 {
+		return nil, paramErrorf("FeeRate", ErrNonPositiveAmount, "got %v", feeRate)
+	}
+	if len(inputs) == 0 {
+		return nil, &ParamError{Field: "WalletInput", Err: ErrMissingValue}
+	}
+
+	_, _, pkScript, err := spendScripts(terms, signed.Path)
+	if err != nil {
+		return nil, err
+	}
+	amount := signed.Fee
+	for _, txOut := range signed.Tx.TxOut {
+		amount += txOut.Value
+	}
+	contractIn := signed.Tx.TxIn[0].PreviousOutPoint
+	prevOuts := txscript.NewMultiPrevOutFetcher(map[wire.OutPoint]*wire.TxOut{
+		contractIn: wire.NewTxOut(amount, pkScript),
+	})
+
+	tx := signed.Tx.Copy()
+	var inputAmount int64
+	witnessSize := 0
+	for _, input := range inputs {
+		if input == nil || input.TxOut == nil {
+			return nil, &ParamError{Field: "WalletInput", Err: ErrMissingValue}
+		}
+		tx.AddTxIn(wire.NewTxIn(&input.OutPoint, nil, nil))
+		prevOuts.AddPrevOut(input.OutPoint, input.TxOut)
+		inputAmount += input.TxOut.Value
+
+		size := input.WitnessSize
+		if size == 0 {
+			size = p2wpkhWitnessSize
+		}
+		// the empty witness already counts its item count
+		witnessSize += size - 1
+	}
+
+	changeAddress, err := decodeAddress(changeAddr, terms.Net)
+	if err != nil {
+		return nil, &ParamError{Field: "ChangeAddress", Err: err}
+	}
+	changePkScript, err := txscript.PayToAddrScript(changeAddress)
+	if err != nil {
+		return nil, err
+	}
+	change := wire.NewTxOut(0, changePkScript)
+	tx.AddTxOut(change)
+
+	weight := int64(tx.SerializeSizeStripped()*(blockchain.WitnessScaleFactor-1) + tx.SerializeSize() + witnessSize)
+	vsize := (weight + blockchain.WitnessScaleFactor - 1) / blockchain.WitnessScaleFactor
+	fee := int64(math.Ceil(feeRate * float64(vsize)))
+	maxFee := params.MaxFee
+	if maxFee == 0 {
+		maxFee = DefaultMaxFee
+	}
+	if fee > maxFee {
+		return nil, paramErrorf("FeeRate", ErrAbsurdFee, "%v fee %d above %d", signed.Path, fee, maxFee)
+	}
+
+	change.Value = signed.Fee + inputAmount - fee
+	if change.Value <= 0 || mempool.IsDust(change, mempool.DefaultMinRelayTxFee) {
+		return nil, paramErrorf("WalletInput", ErrDustOutput, "%v fee %d leaves %d to change",
+			signed.Path, fee, change.Value)
+	}
+
+	// the contract signatures must not have noticed
+	if err := verifyInput(tx, 0, prevOuts, txscript.NewTxSigHashes(tx, prevOuts)); err != nil {
+		return nil, fmt.Errorf("hehtlc: %v: %w", signed.Path, err)
+	}
+
+	return &FeeInputSpend{
+		Tx:       tx,
+		PrevOuts: prevOuts,
+		Fee:      fee,
+		FeeRate:  float64(fee) / float64(vsize),
+	}, nil
+}
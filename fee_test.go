@@ -0,0 +1,292 @@
+package hehtlc
+
+import (
+	"errors"
+	"fmt"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/stretchr/testify/assert"
+	"math"
+	"testing"
+)
+
+func TestFeeRate(t *testing.T) {
+	for _, taproot := range []bool{false, true} {
+		t.Run(fmt.Sprintf("taproot=%t", taproot), func(t *testing.T) {
+			params := GenTestParams()
+			if taproot {
+				params = genTaprootTestParams(nil)
+			}
+			WithFeeRate(2.5)(&params)
+			assert.NoError(t, params.DeriveCollateralUTXO())
+
+			// the collateral takes no fee, so Dep-B leaves what it does not pay
+			// to a change output
+			withChange := params
+			WithChangeAddress(params.Alice2Bech32Address)(&withChange)
+
+			for _, path := range []SpendPath{PathDepositAlice, PathDepositBob, PathCollateralBob} {
+				pathParams := &params
+				if path == PathDepositBob {
+					pathParams = &withChange
+				}
+				spend, err := NewUnsignedSpend(pathParams, path)
+				assert.NoError(t, err)
+				vsize, err := EstimateVSize(&params.Terms, path, spend.Tx)
+				assert.NoError(t, err)
+
+				signed, err := signLocally(pathParams, path)
+				assert.NoError(t, err, path.String())
+				assert.Equal(t, int64(math.Ceil(2.5*float64(vsize))), signed.Fee, path.String())
+				// signatures are estimated at their largest
+				assert.LessOrEqual(t, signed.VSize, vsize, path.String())
+				assert.GreaterOrEqual(t, signed.FeeRate, 2.5, path.String())
+			}
+
+			// Dep-A still pays vcol to Bob, Dep-B funds exactly the collateral
+			// and Col-M still burns vdep and pays vcol and the reserved fee
+			signed, err := signLocally(&params, PathDepositAlice)
+			assert.NoError(t, err)
+			assert.Equal(t, params.Terms.VCol, signed.Tx.TxOut[1].Value)
+			signed, err = signLocally(&withChange, PathDepositBob)
+			assert.NoError(t, err)
+			assert.Equal(t, params.Terms.VDep+params.Terms.VCol+params.Terms.Fee, signed.Tx.TxOut[0].Value)
+			signed, err = signLocally(&params, PathCollateralMiner)
+			assert.NoError(t, err)
+			assert.Equal(t, params.Terms.VDep, signed.Tx.TxOut[0].Value)
+			assert.Equal(t, params.Terms.VCol+params.Terms.Fee, signed.Fee)
+		})
+	}
+
+	t.Run("dust", func(t *testing.T) {
+		params := GenTestParams()
+		WithFeeRate(1000)(&params)
+		WithMaxFee(0)(&params)
+		_, err := NewUnsignedSpend(&params, PathDepositAlice)
+		assert.True(t, errors.Is(err, ErrDustOutput))
+	})
+
+	t.Run("absurd fee", func(t *testing.T) {
+		params := GenTestParams()
+		WithFeeRate(10)(&params)
+		WithMaxFee(1000)(&params)
+		_, err := NewUnsignedSpend(&params, PathDepositBob)
+		assert.True(t, errors.Is(err, ErrAbsurdFee))
+		var paramErr *ParamError
+		assert.True(t, errors.As(err, &paramErr))
+		assert.Equal(t, "FeeRate", paramErr.Field)
+
+		WithMaxFee(0)(&params)
+		WithChangeAddress(params.Alice2Bech32Address)(&params)
+		_, err = NewUnsignedSpend(&params, PathDepositBob)
+		assert.NoError(t, err)
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		params := GenTestParams()
+		WithFeeRate(-1)(&params)
+		assert.True(t, errors.Is(params.Validate(), ErrNonPositiveAmount))
+	})
+}
+
+func TestValueConservation(t *testing.T) {
+	// what the outputs and fee of a signed spend add up to
+	balance := func(signed *SignedSpend) int64 {
+		total := signed.Fee
+		for _, txOut := range signed.Tx.TxOut {
+			total += txOut.Value
+		}
+		return total
+	}
+	change := "tb1qklkpdy0xwcav7q4th97hnxncfd8l8kux4u7pwn"
+
+	t.Run("surplus without change", func(t *testing.T) {
+		params := GenTestParams()
+		WithMaxFee(0)(&params)
+		for _, path := range []SpendPath{PathDepositAlice, PathDepositBob} {
+			_, err := NewUnsignedSpend(&params, path)
+			assert.True(t, errors.Is(err, ErrAmountMismatch), path.String())
+			var paramErr *ParamError
+			assert.True(t, errors.As(err, &paramErr))
+			assert.Equal(t, "ChangeAddress", paramErr.Field)
+		}
+
+		// the collateral is exactly vdep+vcol+fee
+		_, err := NewUnsignedSpend(&params, PathCollateralBob)
+		assert.NoError(t, err)
+	})
+
+	t.Run("change", func(t *testing.T) {
+		params := GenTestParams()
+		WithMaxFee(0)(&params)
+		WithChangeAddress(change)(&params)
+		assert.NoError(t, params.Validate())
+
+		signed, err := signLocally(&params, PathDepositAlice)
+		assert.NoError(t, err)
+		assert.Len(t, signed.Tx.TxOut, 3)
+		assert.Equal(t, params.Terms.VDep, signed.Tx.TxOut[0].Value)
+		assert.Equal(t, int64(200000-100000-500), signed.Tx.TxOut[2].Value)
+		assert.Equal(t, params.Terms.Fee, signed.Fee)
+		assert.Equal(t, params.depositUTXOForAlice.amount, balance(signed))
+
+		signed, err = signLocally(&params, PathDepositBob)
+		assert.NoError(t, err)
+		assert.Len(t, signed.Tx.TxOut, 2)
+		assert.Equal(t, params.Terms.Fee, signed.Fee)
+
+		// Col-B spends the collateral of this Dep-B and has nothing left over
+		assert.NoError(t, params.DeriveCollateralUTXO())
+		signed, err = signLocally(&params, PathCollateralBob)
+		assert.NoError(t, err)
+		assert.Len(t, signed.Tx.TxOut, 1)
+		assert.Equal(t, params.Terms.Fee, signed.Fee)
+	})
+
+	t.Run("change with fee rate", func(t *testing.T) {
+		params := GenTestParams()
+		WithFeeRate(2)(&params)
+		WithChangeAddress(change)(&params)
+		signed, err := signLocally(&params, PathDepositAlice)
+		assert.NoError(t, err)
+		assert.Len(t, signed.Tx.TxOut, 3)
+		assert.Equal(t, params.Terms.VDep, signed.Tx.TxOut[0].Value)
+		assert.GreaterOrEqual(t, signed.FeeRate, 2.0)
+		assert.Equal(t, params.depositUTXOForAlice.amount, balance(signed))
+	})
+
+	t.Run("dropped change with fee rate", func(t *testing.T) {
+		params := GenTestParams()
+		WithFeeRate(5)(&params)
+		WithChangeAddress(change)(&params)
+		// the collateral leaves nothing to change, so Col-B pays for its
+		// own size only
+		spend, err := NewUnsignedSpend(&params, PathCollateralBob)
+		assert.NoError(t, err)
+		assert.Len(t, spend.Tx.TxOut, 1)
+		vsize, err := EstimateVSize(&params.Terms, PathCollateralBob, spend.Tx)
+		assert.NoError(t, err)
+
+		signed, err := signLocally(&params, PathCollateralBob)
+		assert.NoError(t, err)
+		assert.Equal(t, int64(math.Ceil(5*float64(vsize))), signed.Fee)
+		assert.Less(t, signed.FeeRate, 5.1)
+		assert.Equal(t, params.collateralUTXOForBob.amount, balance(signed))
+	})
+
+	t.Run("dust change", func(t *testing.T) {
+		params := GenTestParams()
+		WithMaxFee(0)(&params)
+		WithChangeAddress(change)(&params)
+		params.depositUTXOForAlice.amount = 100000 + 500 + 100
+		signed, err := signLocally(&params, PathDepositAlice)
+		assert.NoError(t, err)
+		assert.Len(t, signed.Tx.TxOut, 2)
+		assert.Equal(t, int64(600), signed.Fee)
+	})
+
+	t.Run("shortfall", func(t *testing.T) {
+		params := GenTestParams()
+		params.collateralUTXOForBob.amount = 100000
+		assert.True(t, errors.Is(params.Validate(), ErrAmountMismatch))
+		_, err := NewUnsignedSpend(&params, PathCollateralBob)
+		assert.True(t, errors.Is(err, ErrAmountMismatch))
+	})
+
+	t.Run("oversized collateral to the miner", func(t *testing.T) {
+		for _, feeRate := range []float64{0, 2} {
+			params := GenTestParams()
+			WithAnchors(AnchorEphemeral)(&params)
+			WithFeeRate(feeRate)(&params)
+			assert.NoError(t, params.DeriveCollateralUTXO())
+			// far more than vdep+vcol+fee+anchors
+			params.collateralUTXOForMiner.amount = 100000000
+			_, err := NewUnsignedSpend(&params, PathCollateralMiner)
+			assert.True(t, errors.Is(err, ErrAmountMismatch))
+			var paramErr *ParamError
+			assert.True(t, errors.As(err, &paramErr))
+			assert.Equal(t, "ChangeAddress", paramErr.Field)
+
+			WithMaxFee(0)(&params)
+			_, err = NewUnsignedSpend(&params, PathCollateralMiner)
+			assert.True(t, errors.Is(err, ErrAmountMismatch))
+
+			// the surplus goes back to the change address, not to the miner
+			WithChangeAddress(change)(&params)
+			signed, err := signLocally(&params, PathCollateralMiner)
+			assert.NoError(t, err)
+			assert.Equal(t, params.Terms.VCol+params.Terms.Fee, signed.Fee)
+			assert.Equal(t, params.collateralUTXOForMiner.amount, balance(signed))
+
+			// a MaxFee below vcol+fee still caps what Col-M pays
+			WithMaxFee(params.Terms.VCol)(&params)
+			_, err = NewUnsignedSpend(&params, PathCollateralMiner)
+			assert.True(t, errors.Is(err, ErrAbsurdFee))
+		}
+	})
+
+	t.Run("invalid change address", func(t *testing.T) {
+		params := GenTestParams()
+		WithChangeAddress("not an address")(&params)
+		assert.True(t, errors.Is(params.Validate(), ErrInvalidAddress))
+	})
+}
+
+func TestAddFeeInputs(t *testing.T) {
+	for _, taproot := range []bool{false, true} {
+		t.Run(fmt.Sprintf("taproot=%t", taproot), func(t *testing.T) {
+			params := GenTestParams()
+			if taproot {
+				params = genTaprootTestParams(nil)
+			}
+			WithSigHash(PathCollateralBob, txscript.SigHashSingle|txscript.SigHashAnyOneCanPay)(&params)
+
+			// Col-B pays no more than the Fee of the terms
+			signed, err := signLocally(&params, PathCollateralBob)
+			assert.NoError(t, err)
+			assert.Equal(t, params.Terms.Fee, signed.Fee)
+
+			wallet, walletKey := testWalletInput(t, &params, 50000)
+			bumped, err := AddFeeInputs(&params, signed, []*WalletInput{wallet}, 20, params.Bob2Bech32Address)
+			assert.NoError(t, err)
+			assert.Len(t, bumped.Tx.TxIn, 2)
+			assert.Len(t, bumped.Tx.TxOut, 2)
+			assert.Equal(t, signed.Tx.TxOut[0], bumped.Tx.TxOut[0])
+
+			sigHashes := txscript.NewTxSigHashes(bumped.Tx, bumped.PrevOuts)
+			witness, err := txscript.WitnessSignature(bumped.Tx, sigHashes, 1, wallet.TxOut.Value,
+				wallet.TxOut.PkScript, txscript.SigHashAll, walletKey.PrivKey, true)
+			assert.NoError(t, err)
+			bumped.Tx.TxIn[1].Witness = witness
+			assert.NoError(t, VerifySpend(bumped.Tx, bumped.PrevOuts))
+
+			collateral := signed.Fee + signed.Tx.TxOut[0].Value
+			final, err := newSignedSpend(PathCollateralBob, bumped.Tx, collateral+wallet.TxOut.Value)
+			assert.NoError(t, err)
+			assert.Equal(t, bumped.Fee, final.Fee)
+			assert.GreaterOrEqual(t, final.FeeRate, 20.0)
+		})
+	}
+
+	t.Run("signed with SIGHASH_ALL", func(t *testing.T) {
+		params := GenTestParams()
+		signed, err := signLocally(&params, PathCollateralBob)
+		assert.NoError(t, err)
+		wallet, _ := testWalletInput(t, &params, 50000)
+		_, err = AddFeeInputs(&params, signed, []*WalletInput{wallet}, 20, params.Bob2Bech32Address)
+		assert.True(t, errors.Is(err, ErrInvalidSigHash))
+	})
+
+	t.Run("Dep-B", func(t *testing.T) {
+		params := GenTestParams()
+		WithSigHash(PathDepositBob, txscript.SigHashSingle|txscript.SigHashAnyOneCanPay)(&params)
+		assert.True(t, errors.Is(params.Validate(), ErrInvalidSigHash))
+
+		// Col-B and Col-M would no longer spend the bumped Dep-B
+		params.Terms.SigHashes = nil
+		signed, err := signLocally(&params, PathDepositBob)
+		assert.NoError(t, err)
+		wallet, _ := testWalletInput(t, &params, 50000)
+		_, err = AddFeeInputs(&params, signed, []*WalletInput{wallet}, 20, params.Bob2Bech32Address)
+		assert.True(t, errors.Is(err, ErrInvalidSigHash))
+	})
+}
@@ -3,300 +3,505 @@ package hehtlc
 import (
 	"bytes"
 	"crypto/sha256"
-	"encoding/hex"
 	"fmt"
+	"github.com/btcsuite/btcd/btcec/v2/schnorr"
 	"github.com/btcsuite/btcd/btcutil"
 	"github.com/btcsuite/btcd/chaincfg"
 	"github.com/btcsuite/btcd/txscript"
 	"github.com/btcsuite/btcd/wire"
 )
 
-func P2WSHAddressFromWitnessScript(witnessScript []byte) btcutil.Address {
+func P2WSHAddressFromWitnessScript(witnessScript []byte, net *chaincfg.Params) (btcutil.Address, error) {
 	// BIP-141: witness program is 0 (version) || SHA256 hash of witness script
 	witnessScriptHash := sha256.Sum256(witnessScript)
 
-	// if using Bitcoin main net then pass &chaincfg.MainNetParams as second argument
-	addr, err := btcutil.NewAddressWitnessScriptHash(witnessScriptHash[:], &chaincfg.TestNet3Params)
+	addr, err := btcutil.NewAddressWitnessScriptHash(witnessScriptHash[:], net)
 	if err != nil {
-		panic(err)
+		return nil, fmt.Errorf("%w: %v", ErrInvalidAddress, err)
 	}
 
-	return addr
+	return addr, nil
 }
 
-func BuildDepositContract(params *Parameters) ([]byte, btcutil.Address) {
-	// public keys extracted from wif.PrivKey
-	pk1 := params.AlicePrivateKey.PrivKey.PubKey().SerializeCompressed()
-	pk2 := params.BobPrivateKey.PrivKey.PubKey().SerializeCompressed()
+// addSignatureCheck adds the check of sigA and sigB every contract branch
+// starts with, in the script form of terms.
+func addSignatureCheck(builder *txscript.ScriptBuilder, terms *ContractTerms) {
+	pkA, pkB := terms.GetAliceBobPks()
+	if terms.Taproot {
+		// tapscript keys are x-only
+		pkA, pkB = schnorr.SerializePubKey(terms.AlicePubKey), schnorr.SerializePubKey(terms.BobPubKey)
+	}
+
+	switch terms.signatureForm() {
+	case ScriptFormMultisig:
+		builder.AddOp(txscript.OP_2)
+		builder.AddData(pkA).AddData(pkB)
+		builder.AddOp(txscript.OP_2)
+		builder.AddOp(txscript.OP_CHECKMULTISIGVERIFY)
+	case ScriptFormCheckSigAdd:
+		builder.AddData(pkA)
+		builder.AddOp(txscript.OP_CHECKSIG)
+		builder.AddData(pkB)
+		builder.AddOp(txscript.OP_CHECKSIGADD)
+		builder.AddOp(txscript.OP_2)
+		builder.AddOp(txscript.OP_NUMEQUALVERIFY)
+	default:
+		builder.AddData(pkA)
+		builder.AddOp(txscript.OP_CHECKSIGVERIFY)
+		builder.AddData(pkB)
+		builder.AddOp(txscript.OP_CHECKSIGVERIFY)
+	}
+}
+
+func BuildDepositContract(terms *ContractTerms) ([]byte, btcutil.Address, error) {
+	if err := terms.Validate(); err != nil {
+		return nil, nil, err
+	}
+
+	witnessScript, err := depositWitnessScript(terms)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	addr, err := P2WSHAddressFromWitnessScript(witnessScript, terms.Net)
+	if err != nil {
+		return nil, nil, err
+	}
 
-	hash_prea := btcutil.Hash160(params.preA)
-	hash_preb := btcutil.Hash160(params.preB)
+	return witnessScript, addr, nil
+}
+
+// depositWitnessScript returns the P2WSH deposit script of terms, which are
+// not validated.
+func depositWitnessScript(terms *ContractTerms) ([]byte, error) {
+	hash_prea := terms.HashA
+	hash_preb := terms.HashB
 
 	builder := txscript.NewScriptBuilder()
 
+	if terms.Miniscript {
+		// or_i(and_v(v:sigs,hash160(hA)),and_v(v:sigs,and_v(v:older(T),hash160(hB))))
+		// each branch checks both signatures, which keeps it non-malleable
+		builder.AddOp(txscript.OP_IF)
+		addSignatureCheck(builder, terms)
+		addHashLock(builder, terms, hash_prea, false)
+		builder.AddOp(txscript.OP_ELSE)
+		addSignatureCheck(builder, terms)
+		addTimelock(builder, terms.encodedT(), terms.TMode)
+		builder.AddOp(txscript.OP_VERIFY)
+		addHashLock(builder, terms, hash_preb, false)
+		builder.AddOp(txscript.OP_ENDIF)
+
+		return builder.Script()
+	}
+
 	// corresponding sigscript
 	// preA || sigA || sigB, or
 	// preB || OF_1 (dummy pre image) || sigA || sigB
-	builder.AddOp(txscript.OP_2)
-	builder.AddData(pk1).AddData(pk2)
-	builder.AddOp(txscript.OP_2)
-	builder.AddOp(txscript.OP_CHECKMULTISIGVERIFY)
+	addSignatureCheck(builder, terms)
 
-	builder.AddOp(txscript.OP_HASH160)
-	builder.AddData(hash_prea)
-	builder.AddOp(txscript.OP_EQUAL)
+	addHashLock(builder, terms, hash_prea, false)
 
 	builder.AddOp(txscript.OP_IF)   // if Alice provides pre_a, the script ends here
 	builder.AddOp(txscript.OP_TRUE) // push the final true value
 
 	builder.AddOp(txscript.OP_ELSE) // else, check Bob's input
-	builder.AddInt64(params.T)      // Bob can spend after T block (relative)
-	builder.AddOp(txscript.OP_CHECKSEQUENCEVERIFY)
+	// Bob can spend after T
+	addTimelock(builder, terms.encodedT(), terms.TMode)
 	builder.AddOp(txscript.OP_DROP) // drop T from stack
 
-	builder.AddOp(txscript.OP_HASH160)
-	builder.AddData(hash_preb)
-	builder.AddOp(txscript.OP_EQUAL)
+	addHashLock(builder, terms, hash_preb, false)
 
 	builder.AddOp(txscript.OP_ENDIF)
 
-	witnessScript, err := builder.Script()
+	return builder.Script()
+}
+
+func BuildCollateralContract(terms *ContractTerms) ([]byte, btcutil.Address, error) {
+	if err := terms.Validate(); err != nil {
+		return nil, nil, err
+	}
+
+	witnessScript, err := collateralWitnessScript(terms)
 	if err != nil {
-		panic(err)
+		return nil, nil, err
 	}
 
-	return witnessScript, P2WSHAddressFromWitnessScript(witnessScript)
-}
+	addr, err := P2WSHAddressFromWitnessScript(witnessScript, terms.Net)
+	if err != nil {
+		return nil, nil, err
+	}
 
-func BuildCollateralContract(params *Parameters) ([]byte, btcutil.Address) {
-	pk1, pk2 := params.GetAliceBobPks()
+	return witnessScript, addr, nil
+}
 
-	hashPreA := btcutil.Hash160(params.preA)
-	hashPreB := btcutil.Hash160(params.preB)
+// collateralWitnessScript returns the P2WSH collateral script of terms, which
+// are not validated.
+func collateralWitnessScript(terms *ContractTerms) ([]byte, error) {
+	hashPreA := terms.HashA
+	hashPreB := terms.HashB
 
 	builder := txscript.NewScriptBuilder()
 
+	if terms.Miniscript {
+		// or_i(and_v(v:sigs,older(ell)),and_v(v:sigs,and_v(v:hash160(hA),hash160(hB))))
+		builder.AddOp(txscript.OP_IF)
+		addSignatureCheck(builder, terms)
+		addTimelock(builder, terms.encodedEll(), terms.EllMode) // ell is left as the final true value
+		builder.AddOp(txscript.OP_ELSE)
+		addSignatureCheck(builder, terms)
+		addHashLock(builder, terms, hashPreA, true)
+		addHashLock(builder, terms, hashPreB, false)
+		builder.AddOp(txscript.OP_ENDIF)
+
+		return builder.Script()
+	}
+
 	// corresponding sigscript
 	// t >= l || sigA || sigB, or
 	// preB || preA || sigA || sigB
-	builder.AddOp(txscript.OP_2)
-	builder.AddData(pk1).AddData(pk2)
-	builder.AddOp(txscript.OP_2)
-	builder.AddOp(txscript.OP_CHECKMULTISIGVERIFY)
+	addSignatureCheck(builder, terms)
 
-	builder.AddOp(txscript.OP_HASH160)
-	builder.AddData(hashPreA)
-	builder.AddOp(txscript.OP_EQUAL)
+	addHashLock(builder, terms, hashPreA, false)
 
 	builder.AddOp(txscript.OP_IF) // if Alice provides pre_a, the script ends here
-	builder.AddOp(txscript.OP_HASH160)
-	builder.AddData(hashPreB)
-	builder.AddOp(txscript.OP_EQUAL)
+	addHashLock(builder, terms, hashPreB, false)
 
 	builder.AddOp(txscript.OP_ELSE) // else, check Bob's input
-	builder.AddInt64(params.ell)
-	builder.AddOp(txscript.OP_CHECKSEQUENCEVERIFY)
+	addTimelock(builder, terms.encodedEll(), terms.EllMode)
 	builder.AddOp(txscript.OP_DROP) // drop ell from stack
 	builder.AddOp(txscript.OP_TRUE)
 	builder.AddOp(txscript.OP_ENDIF)
 
-	witnessScript, err := builder.Script()
-	if err != nil {
-		panic(err)
+	return builder.Script()
+}
+
+// addTimelock checks that value, relative or absolute as mode says and
+// encoded by encodeTimelock, has passed. Like the opcodes checking it, it
+// leaves value on the stack.
+func addTimelock(builder *txscript.ScriptBuilder, value int64, mode TimelockMode) {
+	builder.AddInt64(value)
+	if mode == TimelockAbsolute {
+		builder.AddOp(txscript.OP_CHECKLOCKTIMEVERIFY)
+	} else {
+		builder.AddOp(txscript.OP_CHECKSEQUENCEVERIFY)
 	}
+}
 
-	witnessScriptHash := sha256.Sum256(witnessScript)
-	fmt.Println("[Col] witness script", hex.EncodeToString(witnessScript[:]))
-	fmt.Println("[Col] witness script hash", hex.EncodeToString(witnessScriptHash[:]))
+// setTimelock makes the only input of tx satisfy value, encoded by
+// encodeTimelock, in mode: its sequence is value for a relative timelock,
+// while an absolute one sets the lock time of tx and a non-final sequence
+// that enables it.
+func setTimelock(tx *wire.MsgTx, value int64, mode TimelockMode) {
+	if mode == TimelockAbsolute {
+		// https://github.com/bitcoin/bips/blob/master/bip-0065.mediawiki
+		tx.LockTime = uint32(value)
+		tx.TxIn[0].Sequence = wire.MaxTxInSequenceNum - 1
+		return
+	}
 
-	return witnessScript, P2WSHAddressFromWitnessScript(witnessScript)
+	// activate OP_CSV
+	// https://github.com/bitcoin/bips/blob/master/bip-0112.mediawiki
+	// https://github.com/bitcoin/bips/blob/master/bip-0068.mediawiki
+	tx.TxIn[0].Sequence = uint32(value)
 }
 
-func SpendHeHTLCDepositAlice(params *Parameters) string {
-	// output address
-	destinationAddrByteAlice, err := txscript.PayToAddrScript(params.GetAliceAddressOrPanic())
-	if err != nil {
-		panic(err)
+// addHashLock checks the preimage on top of the stack against hash with the
+// hash function of terms, after checking its size if terms fix one.
+func addHashLock(builder *txscript.ScriptBuilder, terms *ContractTerms, hash []byte, verify bool) {
+	if size := terms.preimageSize(); size > 0 {
+		builder.AddOp(txscript.OP_SIZE)
+		builder.AddInt64(int64(size))
+		builder.AddOp(txscript.OP_EQUALVERIFY)
 	}
-	destinationAddrByteBob, err := txscript.PayToAddrScript(params.GetBobAddressOrPanic())
+	builder.AddOp(terms.HashFunc.opcode())
+	builder.AddData(hash)
+	if verify {
+		builder.AddOp(txscript.OP_EQUALVERIFY)
+	} else {
+		builder.AddOp(txscript.OP_EQUAL)
+	}
+}
+
+// checkSigners makes sure params carry both parties' keys, which the
+// SpendHeHTLC* functions use to produce sigA and sigB locally.
+func checkSigners(params *Parameters) error {
+	if params.Alice == nil || params.Alice.PrivateKey == nil {
+		return fmt.Errorf("%w: Alice's private key", ErrMissingSecret)
+	}
+	if params.Bob == nil || params.Bob.PrivateKey == nil {
+		return fmt.Errorf("%w: Bob's private key", ErrMissingSecret)
+	}
+	return nil
+}
+
+// signLocally produces both signatures for path with the keys in params and
+// assembles the witness with the preimages in params.
+func signLocally(params *Parameters, path SpendPath) (*SignedSpend, error) {
+	if err := params.Validate(); err != nil {
+		return nil, err
+	}
+	if err := checkSigners(params); err != nil {
+		return nil, err
+	}
+
+	spend, err := NewUnsignedSpend(params, path)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 
-	redeemTxOutAlice := wire.NewTxOut(int64(params.vdep), destinationAddrByteAlice)
-	redeemTxOutBob := wire.NewTxOut(int64(params.vcol), destinationAddrByteBob)
+	if _, err := spend.SignAs(RoleAlice, params.Alice.PrivateKey); err != nil {
+		return nil, err
+	}
+	if _, err := spend.SignAs(RoleBob, params.Bob.PrivateKey); err != nil {
+		return nil, err
+	}
 
-	witnessScript, _ := BuildDepositContract(params)
+	return spend.Finalize(params.Alice.PreA, params.Bob.PreB)
+}
 
-	// get the UTXO
-	txIn := wire.NewTxIn(params.GetDepositUTXO4Alice(), nil, nil)
+func SpendHeHTLCDepositAlice(params *Parameters) (*SignedSpend, error) {
+	return signLocally(params, PathDepositAlice)
+}
 
-	// a new tx
-	tvDepAlice := wire.NewMsgTx(2) // need version 2 to use OP_CSV (https://github.com/bitcoin/bips/blob/master/bip-0112.mediawiki)
-	tvDepAlice.AddTxIn(txIn)
-	tvDepAlice.AddTxOut(redeemTxOutAlice)
-	tvDepAlice.AddTxOut(redeemTxOutBob)
+func SpendHeHTLCDepositBob(params *Parameters) (*SignedSpend, error) {
+	return signLocally(params, PathDepositBob)
+}
 
-	// BIP-143 signs the amount of UTXO too
-	amount := params.depositUTXOForAlice.amount
-	prevOutput := txscript.NewCannedPrevOutputFetcher(nil, amount)
+func SpendHeHTLCCollateralBob(params *Parameters) (*SignedSpend, error) {
+	return signLocally(params, PathCollateralBob)
+}
 
-	sigHash := txscript.NewTxSigHashes(tvDepAlice, prevOutput)
+func SpendHeHTLCCollateralMiner(params *Parameters) (*SignedSpend, error) {
+	return signLocally(params, PathCollateralMiner)
+}
 
-	sigA, err := txscript.RawTxInWitnessSignature(tvDepAlice, sigHash, 0, amount, witnessScript, txscript.SigHashAll, params.AlicePrivateKey.PrivKey)
+// CollateralUTXOFromDepositBob returns the outpoint and amount of the
+// collateral output created by txDepBob. Dep-B spends a segwit output, so its
+// txid does not depend on the witness and is known before it is signed.
+func CollateralUTXOFromDepositBob(txDepBob *wire.MsgTx, terms *ContractTerms) (*wire.OutPoint, int64, error) {
+	colPkScript, err := collateralPkScript(terms)
 	if err != nil {
-		panic(err)
+		return nil, 0, err
+	}
+
+	for i, txOut := range txDepBob.TxOut {
+		if bytes.Equal(txOut.PkScript, colPkScript) {
+			txid := txDepBob.TxHash()
+			return wire.NewOutPoint(&txid, uint32(i)), txOut.Value, nil
+		}
 	}
 
-	sigB, err := txscript.RawTxInWitnessSignature(tvDepAlice, sigHash, 0, amount, witnessScript, txscript.SigHashAll, params.BobPrivateKey.PrivKey)
+	return nil, 0, fmt.Errorf("%w: Dep-B %v has no output paying the collateral contract",
+		ErrBadOutpoint, txDepBob.TxHash())
+}
+
+// spendScripts returns what a spend of path needs from the contract it
+// spends: the script it executes, the control block proving that script is a
+// leaf of the taproot output (nil for P2WSH) and the output script.
+func spendScripts(terms *ContractTerms, path SpendPath) ([]byte, []byte, []byte, error) {
+	var deposit bool
+	switch path {
+	case PathDepositAlice, PathDepositBob:
+		deposit = true
+	case PathCollateralBob, PathCollateralMiner:
+	default:
+		return nil, nil, nil, fmt.Errorf("hehtlc: unknown spend path %v", path)
+	}
+
+	if terms.Taproot {
+		var (
+			contract *TaprootContract
+			err      error
+		)
+		if deposit {
+			contract, err = BuildTaprootDepositContract(terms)
+		} else {
+			contract, err = BuildTaprootCollateralContract(terms)
+		}
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		script, controlBlock, err := contract.LeafScript(path)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		return script, controlBlock, contract.PkScript, nil
+	}
+
+	var (
+		witnessScript []byte
+		err           error
+	)
+	if deposit {
+		witnessScript, _, err = BuildDepositContract(terms)
+	} else {
+		witnessScript, _, err = BuildCollateralContract(terms)
+	}
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	pkScript, err := p2wshScript(witnessScript)
 	if err != nil {
-		panic(err)
+		return nil, nil, nil, err
 	}
+	return witnessScript, nil, pkScript, nil
+}
 
-	//!!! everything below is NOT covered by signatures.
-	// See https://wiki.bitcoinsv.io/index.php/SIGHASH_flags
+// collateralPkScript returns the output script Dep-B pays the collateral to.
+func collateralPkScript(terms *ContractTerms) ([]byte, error) {
+	_, _, pkScript, err := spendScripts(terms, PathCollateralBob)
+	return pkScript, err
+}
 
-	// witness stack
-	tvDepAlice.TxIn[0].Witness = wire.TxWitness{
-		params.preA,
-		[]byte{}, // dummy value for MULTISIG must be empty per https://github.com/bitcoin/bips/blob/master/bip-0147.mediawiki
-		sigA,
-		sigB,
-		witnessScript,
+// unsignedDepositAlice builds Dep-A: Alice reveals preA and the deposit is
+// split into vdep for Alice and vcol for Bob. The cooperative close pays the
+// same outputs, so path is either and sizes the fee by its witness.
+func unsignedDepositAlice(params *Parameters, path SpendPath) (*wire.MsgTx, int64, error) {
+	// output address
+	aliceAddr, err := params.GetAliceAddress()
+	if err != nil {
+		return nil, 0, err
+	}
+	bobAddr, err := params.GetBobAddress()
+	if err != nil {
+		return nil, 0, err
+	}
+	destinationAddrByteAlice, err := txscript.PayToAddrScript(aliceAddr)
+	if err != nil {
+		return nil, 0, err
+	}
+	destinationAddrByteBob, err := txscript.PayToAddrScript(bobAddr)
+	if err != nil {
+		return nil, 0, err
 	}
 
-	var signedTx bytes.Buffer
-	err = tvDepAlice.Serialize(&signedTx)
+	redeemTxOutAlice := wire.NewTxOut(params.Terms.VDep, destinationAddrByteAlice)
+	redeemTxOutBob := wire.NewTxOut(params.Terms.VCol, destinationAddrByteBob)
+
+	// get the UTXO
+	depositUTXO, err := params.GetDepositUTXO4Alice()
 	if err != nil {
-		panic(err)
+		return nil, 0, err
+	}
+	txIn := wire.NewTxIn(depositUTXO, nil, nil)
+
+	// a new tx
+	tvDepAlice := wire.NewMsgTx(2) // need version 2 to use OP_CSV (https://github.com/bitcoin/bips/blob/master/bip-0112.mediawiki)
+	tvDepAlice.AddTxIn(txIn)
+	tvDepAlice.AddTxOut(redeemTxOutAlice)
+	tvDepAlice.AddTxOut(redeemTxOutBob)
+	if err := addAnchors(params, tvDepAlice); err != nil {
+		return nil, 0, err
 	}
 
-	hexSignedTx := hex.EncodeToString(signedTx.Bytes())
+	// Alice pays the fee out of vdep
+	amount := params.depositUTXOForAlice.amount
+	if err := balanceSpend(params, path, tvDepAlice, amount, 0); err != nil {
+		return nil, 0, err
+	}
 
-	return hexSignedTx
+	return tvDepAlice, amount, nil
 }
 
-func SpendHeHTLCDepositBob(params *Parameters) (*wire.MsgTx, error) {
-	depositUTXO := params.GetDepositUTXOForBob()
+// unsignedDepositBob builds Dep-B: after T blocks Bob moves the deposit into
+// the collateral contract.
+func unsignedDepositBob(params *Parameters) (*wire.MsgTx, int64, error) {
+	depositUTXO, err := params.GetDepositUTXOForBob()
+	if err != nil {
+		return nil, 0, err
+	}
 	txIn := wire.NewTxIn(depositUTXO, nil, nil)
 
-	depPkScript, _ := BuildDepositContract(params)
-
 	// a new tx
 	txDepBob := wire.NewMsgTx(2) // need version 2 to use OP_CSV (https://github.com/bitcoin/bips/blob/master/bip-0112.mediawiki)
 	txDepBob.AddTxIn(txIn)
 
-	// witness script for the collateral
-	_, colP2WSHAddress := BuildCollateralContract(params)
-	colPkScript, err := txscript.PayToAddrScript(colP2WSHAddress)
+	// output script of the collateral
+	colPkScript, err := collateralPkScript(&params.Terms)
 	if err != nil {
-		return nil, err
+		return nil, 0, err
 	}
 
+	// the collateral also pays the anchors of Col-B
 	redeemTxOutCol := wire.NewTxOut(
-		params.vdep+params.vcol+params.fee,
+		params.Terms.VDep+params.Terms.VCol+params.Terms.Fee+params.anchorValue(),
 		colPkScript)
 
 	txDepBob.AddTxOut(redeemTxOutCol)
+	if err := addAnchors(params, txDepBob); err != nil {
+		return nil, 0, err
+	}
 
-	// activate OP_CSV
-	// https://github.com/bitcoin/bips/blob/master/bip-0112.mediawiki
-	// https://github.com/bitcoin/bips/blob/master/bip-0068.mediawiki
-	txDepBob.TxIn[0].Sequence = uint32(params.T)
+	setTimelock(txDepBob, params.Terms.encodedT(), params.Terms.TMode)
 
-	// sign with BIP-143 amount of UTXO
 	amount := params.depositUTXOForBob.amount
-	prevOutput := txscript.NewCannedPrevOutputFetcher(nil, amount)
+	// the collateral is fixed by the terms, so nothing can absorb the fee
+	if err := balanceSpend(params, PathDepositBob, txDepBob, amount, noSpender); err != nil {
+		return nil, 0, err
+	}
 
-	sigHash := txscript.NewTxSigHashes(txDepBob, prevOutput)
+	return txDepBob, amount, nil
+}
 
-	sigA, err := txscript.RawTxInWitnessSignature(txDepBob, sigHash, 0, amount, depPkScript, txscript.SigHashAll, params.AlicePrivateKey.PrivKey)
+// unsignedCollateralBob builds Col-B: after ell blocks Bob claims vdep+vcol.
+func unsignedCollateralBob(params *Parameters) (*wire.MsgTx, int64, error) {
+	bobAddr, err := params.GetBobAddress()
 	if err != nil {
-		return nil, err
+		return nil, 0, err
 	}
-
-	sigB, err := txscript.RawTxInWitnessSignature(txDepBob, sigHash, 0, amount, depPkScript, txscript.SigHashAll, params.BobPrivateKey.PrivKey)
+	destinationAddrByteBob, err := txscript.PayToAddrScript(bobAddr)
 	if err != nil {
-		return nil, err
+		return nil, 0, err
 	}
 
-	//!!! everything below is NOT covered by signatures.
-	// See https://wiki.bitcoinsv.io/index.php/SIGHASH_flags
+	// vdep + vcol to Bob
+	redeemTxOutBob := wire.NewTxOut(params.Terms.VCol+params.Terms.VDep, destinationAddrByteBob)
 
-	// witness stack
-	txDepBob.TxIn[0].Witness = wire.TxWitness{
-		params.preB,
-		[]byte{0x00}, // add dummy value to be consumed by first OP_HASH160
-		[]byte{},     // dummy value for MULTISIG must be empty per https://github.com/bitcoin/bips/blob/master/bip-0147.mediawiki
-		sigA,
-		sigB,
-		depPkScript,
+	// txid & utxo index
+	collateralUTXO, err := params.collateralUTXO(params.collateralUTXOForBob)
+	if err != nil {
+		return nil, 0, err
 	}
-
-	return txDepBob, nil
-}
-
-func SpendHeHTLCCollateralBob(params *Parameters) (*wire.MsgTx, error) {
-	redeemScript, _ := BuildCollateralContract(params)
-
-	destinationAddrByteBob, err := txscript.PayToAddrScript(params.GetBobAddressOrPanic())
+	collateralOutPoint, err := collateralUTXO.outPoint()
 	if err != nil {
-		return nil, err
+		return nil, 0, err
 	}
-
-	// vdep + vcol to Bob
-	redeemTxOutBob := wire.NewTxOut(params.vcol+params.vdep, destinationAddrByteBob)
-
-	// txid & utxo index
-	txIn := wire.NewTxIn(params.GetCollateralUTXOForBob(), nil, nil)
+	txIn := wire.NewTxIn(collateralOutPoint, nil, nil)
 
 	// a new tx
 	redeemTx := wire.NewMsgTx(2) // need version 2 to use OP_CSV (https://github.com/bitcoin/bips/blob/master/bip-0112.mediawiki)
 	redeemTx.AddTxIn(txIn)
 	redeemTx.AddTxOut(redeemTxOutBob)
-
-	// activate OP_CSV
-	// https://github.com/bitcoin/bips/blob/master/bip-0112.mediawiki
-	// https://github.com/bitcoin/bips/blob/master/bip-0068.mediawiki
-	redeemTx.TxIn[0].Sequence = uint32(params.ell)
-
-	// signing the tx
-	amount := params.collateralUTXOForBob.amount
-	prevOutput := txscript.NewCannedPrevOutputFetcher(nil, amount)
-
-	sigHash := txscript.NewTxSigHashes(redeemTx, prevOutput)
-
-	sigA, err := txscript.RawTxInWitnessSignature(redeemTx, sigHash, 0, amount, redeemScript, txscript.SigHashAll, params.AlicePrivateKey.PrivKey)
-	if err != nil {
-		return nil, err
-	}
-
-	sigB, err := txscript.RawTxInWitnessSignature(redeemTx, sigHash, 0, amount, redeemScript, txscript.SigHashAll, params.BobPrivateKey.PrivKey)
-	if err != nil {
-		return nil, err
+	if err := addAnchors(params, redeemTx); err != nil {
+		return nil, 0, err
 	}
 
-	//!!! everything below is NOT covered by signatures.
-	// See https://wiki.bitcoinsv.io/index.php/SIGHASH_flags
+	setTimelock(redeemTx, params.Terms.encodedEll(), params.Terms.EllMode)
 
-	// witness stack
-	redeemTx.TxIn[0].Witness = wire.TxWitness{
-		[]byte{0x00}, // add dummy value to be consumed by first OP_HASH160
-		[]byte{},     // dummy value for MULTISIG must be empty per https://github.com/bitcoin/bips/blob/master/bip-0147.mediawiki
-		sigA,
-		sigB,
-		redeemScript,
+	if err := balanceSpend(params, PathCollateralBob, redeemTx, collateralUTXO.amount, 0); err != nil {
+		return nil, 0, err
 	}
 
-	return redeemTx, nil
+	return redeemTx, collateralUTXO.amount, nil
 }
 
-func SpendHeHTLCCollateralMiner(params *Parameters) (*wire.MsgTx, error) {
+// unsignedCollateralMiner builds Col-M: with both preimages public, anyone
+// can burn vdep and leave vcol to the miner as fee.
+func unsignedCollateralMiner(params *Parameters) (*wire.MsgTx, int64, error) {
 	// a new tx
 	redeemTx := wire.NewMsgTx(2) // need version 2 to use OP_CSV (https://github.com/bitcoin/bips/blob/master/bip-0112.mediawiki)
 
 	// UTXO
-	txIn := wire.NewTxIn(params.GetCollateralUTXOForMiner(), nil, nil)
+	collateralUTXO, err := params.collateralUTXO(params.collateralUTXOForMiner)
+	if err != nil {
+		return nil, 0, err
+	}
+	collateralOutPoint, err := collateralUTXO.outPoint()
+	if err != nil {
+		return nil, 0, err
+	}
+	txIn := wire.NewTxIn(collateralOutPoint, nil, nil)
 	redeemTx.AddTxIn(txIn)
 
 	// create a single output with vdep provably unspendable
@@ -305,7 +510,7 @@ func SpendHeHTLCCollateralMiner(params *Parameters) (*wire.MsgTx, error) {
 	builder.AddOp(txscript.OP_RETURN)
 	unspendable, err := builder.Script()
 	if err != nil {
-		return nil, err
+		return nil, 0, err
 	}
 
 	// must hide OP_RETURN in a P2SH otherwise the transaction will be considered non-standard (too small)
@@ -313,49 +518,26 @@ func SpendHeHTLCCollateralMiner(params *Parameters) (*wire.MsgTx, error) {
 	//calculate the hash160 of the redeem script
 	redeemHash := btcutil.Hash160(unspendable)
 
-	addr, err := btcutil.NewAddressScriptHashFromHash(redeemHash, &chaincfg.TestNet3Params)
+	addr, err := btcutil.NewAddressScriptHashFromHash(redeemHash, params.Terms.Net)
 	if err != nil {
-		panic(err)
+		return nil, 0, err
 	}
 
 	pkScript, err := txscript.PayToAddrScript(addr)
 	if err != nil {
-		return nil, err
+		return nil, 0, err
 	}
 
-	redeemTxOutBurn := wire.NewTxOut(params.vdep, pkScript)
+	redeemTxOutBurn := wire.NewTxOut(params.Terms.VDep, pkScript)
 
 	redeemTx.AddTxOut(redeemTxOutBurn)
-
-	// sign the tx
-	amount := params.collateralUTXOForMiner.amount
-	prevOutput := txscript.NewCannedPrevOutputFetcher(nil, amount)
-
-	sigHash := txscript.NewTxSigHashes(redeemTx, prevOutput)
-
-	colWitnessScript, _ := BuildCollateralContract(params)
-	siga, err := txscript.RawTxInWitnessSignature(redeemTx, sigHash, 0, amount, colWitnessScript, txscript.SigHashAll, params.AlicePrivateKey.PrivKey)
-	if err != nil {
-		return nil, err
+	if err := addAnchors(params, redeemTx); err != nil {
+		return nil, 0, err
 	}
 
-	sigb, err := txscript.RawTxInWitnessSignature(redeemTx, sigHash, 0, amount, colWitnessScript, txscript.SigHashAll, params.BobPrivateKey.PrivKey)
-	if err != nil {
-		return nil, err
-	}
-
-	//!!! everything below is NOT covered by signatures.
-	// See https://wiki.bitcoinsv.io/index.php/SIGHASH_flags
-
-	// witness stack
-	redeemTx.TxIn[0].Witness = wire.TxWitness{
-		params.preB,
-		params.preA,
-		[]byte{}, // dummy value for MULTISIG must be empty per https://github.com/bitcoin/bips/blob/master/bip-0147.mediawiki
-		siga,
-		sigb,
-		colWitnessScript,
+	if err := balanceSpend(params, PathCollateralMiner, redeemTx, collateralUTXO.amount, noSpender); err != nil {
+		return nil, 0, err
 	}
 
-	return redeemTx, nil
+	return redeemTx, collateralUTXO.amount, nil
 }
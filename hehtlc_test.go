@@ -1,18 +1,22 @@
 package hehtlc
 
 import (
-	"bytes"
+	"crypto/sha256"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
 	"github.com/stretchr/testify/assert"
+	"strings"
 	"testing"
 )
 
 func TestSpendHeHTLCDepositAlice(t *testing.T) {
 	params := GenTestParams()
 
-	depositScript, depositAddr := BuildDepositContract(&params)
+	depositScript, depositAddr, err := BuildDepositContract(&params.Terms)
+	assert.NoError(t, err)
 	fmt.Println("[Dep] witness script (asm):", func() string {
 		s, _ := txscript.DisasmString(depositScript)
 		return s
@@ -26,9 +30,13 @@ func TestSpendHeHTLCDepositAlice(t *testing.T) {
 	// Testnet tx: https://www.blockchain.com/btc-testnet/tx/5dbb7c677b3177700a541ecc23604bbfdb5ddd5a463e924428ae096646214180
 	//
 	t.Run("test tx_vdep_alice", func(t *testing.T) {
-		txvDepAlice := SpendHeHTLCDepositAlice(&params)
-		fmt.Println("spend by Alice:", txvDepAlice)
-		assert.Equal(t, txvDepAlice, params.expectedTxDepAlice)
+		txvDepAlice, err := SpendHeHTLCDepositAlice(&params)
+		assert.NoError(t, err)
+		fmt.Println("spend by Alice:", txvDepAlice.Hex)
+		assert.Equal(t, txvDepAlice.Hex, params.expectedTxDepAlice)
+		assert.Equal(t, PathDepositAlice, txvDepAlice.Path)
+		assert.Equal(t, "5dbb7c677b3177700a541ecc23604bbfdb5ddd5a463e924428ae096646214180", txvDepAlice.TxID.String())
+		assert.Equal(t, int64(100000), txvDepAlice.Fee)
 	})
 
 	//
@@ -40,18 +48,12 @@ func TestSpendHeHTLCDepositAlice(t *testing.T) {
 		txDepBob, err := SpendHeHTLCDepositBob(&params)
 		assert.NoError(t, err)
 
-		var signedTx bytes.Buffer
-		err = txDepBob.Serialize(&signedTx)
-		if err != nil {
-			panic(err)
-		}
-
-		hexSignedTx := hex.EncodeToString(signedTx.Bytes())
-		assert.Equal(t, params.expectedTxDepBob, hexSignedTx)
+		assert.Equal(t, params.expectedTxDepBob, txDepBob.Hex)
+		assert.Equal(t, PathDepositBob, txDepBob.Path)
 
-		fmt.Println("[Dep] spend tx by Bob", hexSignedTx)
+		fmt.Println("[Dep] spend tx by Bob", txDepBob.Hex)
 
-		fmt.Println("non-malleable txid", txDepBob.TxHash())
+		fmt.Println("non-malleable txid", txDepBob.TxID)
 	})
 
 	//
@@ -63,12 +65,11 @@ func TestSpendHeHTLCDepositAlice(t *testing.T) {
 		txColBob, err := SpendHeHTLCCollateralBob(&params)
 		assert.NoError(t, err)
 
-		var tx bytes.Buffer
-		err = txColBob.Serialize(&tx)
-		assert.NoError(t, err)
-
-		fmt.Println("spend collateral by Bob", hex.EncodeToString(tx.Bytes()))
-		assert.Equal(t, params.expectedTxColBob, hex.EncodeToString(tx.Bytes()))
+		fmt.Println("spend collateral by Bob", txColBob.Hex)
+		assert.Equal(t, params.expectedTxColBob, txColBob.Hex)
+		assert.Equal(t, "a3f2902a3e7d3bd81295fc020a2a211dbf00b428f7bc6e93c4cfc12f7a55a628", txColBob.TxID.String())
+		assert.Equal(t, params.Terms.Fee, txColBob.Fee)
+		assert.Equal(t, (txColBob.Weight+3)/4, txColBob.VSize)
 	})
 
 	// TEST 4: COLLATERAL SPENT by MINER (Col-M)
@@ -78,11 +79,348 @@ func TestSpendHeHTLCDepositAlice(t *testing.T) {
 		txColMiner, err := SpendHeHTLCCollateralMiner(&params)
 		assert.NoError(t, err)
 
-		var tx bytes.Buffer
-		err = txColMiner.Serialize(&tx)
+		fmt.Println("[Col] spent by Miner", txColMiner.Hex)
+		assert.Equal(t, params.expectedTxColMiner, txColMiner.Hex)
+		assert.Equal(t, "78b7ec346dc7ef75295ba26d1705cb791da23a97ff1511e28321e2b62f5de689", txColMiner.TxID.String())
+	})
+
+	// Malformed input is reported, never panics.
+	t.Run("test errors", func(t *testing.T) {
+		badParams := GenTestParams()
+		badParams.collateralUTXOForBob.txid = "not a txid"
+		_, err := SpendHeHTLCCollateralBob(&badParams)
+		assert.True(t, errors.Is(err, ErrBadOutpoint))
+
+		badParams = GenTestParams()
+		badParams.Bob2Bech32Address = "bc1qw508d6qejxtdg4y5r3zarvary0c5xw7kv8f3t4"
+		_, err = SpendHeHTLCDepositAlice(&badParams)
+		assert.True(t, errors.Is(err, ErrWrongNetwork))
+
+		badParams = GenTestParams()
+		badParams.Terms.T = MaxRelativeLockTime + 1
+		_, _, err = BuildDepositContract(&badParams.Terms)
+		assert.True(t, errors.Is(err, ErrTimelockOutOfRange))
+	})
+}
+
+func TestDerivedCollateralUTXO(t *testing.T) {
+	params := GenTestParams()
+
+	txDepBob, err := SpendHeHTLCDepositBob(&params)
+	assert.NoError(t, err)
+
+	outpoint, amount, err := CollateralUTXOFromDepositBob(txDepBob.Tx, &params.Terms)
+	assert.NoError(t, err)
+	assert.Equal(t, txDepBob.TxID, outpoint.Hash)
+	assert.Equal(t, uint32(0), outpoint.Index)
+	assert.Equal(t, params.Terms.VDep+params.Terms.VCol+params.Terms.Fee, amount)
+
+	// The testnet Col-M spent the output of our Dep-B, so it can be rebuilt
+	// without its hardcoded outpoint, before Dep-B is signed.
+	params.collateralUTXOForMiner = fundingUTXO{}
+	assert.NoError(t, params.Validate())
+
+	txColMiner, err := SpendHeHTLCCollateralMiner(&params)
+	assert.NoError(t, err)
+	assert.Equal(t, params.expectedTxColMiner, txColMiner.Hex)
+
+	assert.NoError(t, params.DeriveCollateralUTXO())
+	colOutPoint, err := params.GetCollateralUTXOForBob()
+	assert.NoError(t, err)
+	assert.Equal(t, *outpoint, *colOutPoint)
+
+	_, _, err = CollateralUTXOFromDepositBob(txColMiner.Tx, &params.Terms)
+	assert.True(t, errors.Is(err, ErrBadOutpoint))
+}
+
+func TestHashFuncs(t *testing.T) {
+	for _, fn := range []HashFunc{HashFuncHash160, HashFuncSHA256, HashFuncHash256} {
+		for _, taproot := range []bool{false, true} {
+			params := GenTestParams()
+			if taproot {
+				params = genTaprootTestParams(nil)
+			}
+			params.Terms.HashFunc = fn
+			params.Terms.HashA = fn.Sum(params.Alice.PreA)
+			params.Terms.HashB = fn.Sum(params.Bob.PreB)
+
+			t.Run(fmt.Sprintf("%v taproot=%t", fn, taproot), func(t *testing.T) {
+				assert.Len(t, params.Terms.HashA, fn.Size())
+				assert.NoError(t, params.Alice.Check(&params.Terms))
+
+				for _, path := range setupPaths {
+					signed, err := signLocally(&params, path)
+					assert.NoError(t, err, path.String())
+
+					classified, err := ClassifyTx(signed.Tx, prevOutFetcher(t, &params, path))
+					assert.NoError(t, err)
+					if assert.Len(t, classified, 1) {
+						assert.Equal(t, path, classified[0].Path)
+					}
+				}
+
+				signed, err := signLocally(&params, PathCollateralMiner)
+				assert.NoError(t, err)
+				revealed, err := ExtractPreimages(signed.Tx, &params.Terms)
+				assert.NoError(t, err)
+				assert.Equal(t, params.Alice.PreA, revealed.PreA)
+				assert.Equal(t, params.Bob.PreB, revealed.PreB)
+
+				if !taproot {
+					deposit, _, err := BuildDepositContract(&params.Terms)
+					assert.NoError(t, err)
+					parsed, err := ParseDepositContract(deposit)
+					assert.NoError(t, err)
+					assert.Equal(t, fn, parsed.HashFunc)
+					assert.NoError(t, CheckDepositContract(deposit, &params.Terms))
+				}
+			})
+		}
+	}
+
+	t.Run("lightning payment hash", func(t *testing.T) {
+		preimage := make([]byte, 32)
+		preimage[0] = 1
+		paymentHash := sha256.Sum256(preimage)
+		assert.Equal(t, paymentHash[:], HashFuncSHA256.Sum(preimage))
+	})
+
+	t.Run("hash lock size", func(t *testing.T) {
+		params := GenTestParams()
+		params.Terms.HashFunc = HashFuncSHA256
+		err := params.Terms.Validate()
+		assert.True(t, errors.Is(err, ErrInvalidHashLock))
+
+		params.Terms.HashFunc = HashFunc(7)
+		err = params.Terms.Validate()
+		assert.True(t, errors.Is(err, ErrInvalidHashLock))
+	})
+}
+
+// prevOutFetcher returns the output the spend of path under params spends.
+func prevOutFetcher(t *testing.T, params *Parameters, path SpendPath) txscript.PrevOutputFetcher {
+	unsigned, err := NewUnsignedSpend(params, path)
+	assert.NoError(t, err)
+	return txscript.NewCannedPrevOutputFetcher(unsigned.PkScript, unsigned.Amount)
+}
+
+func TestPreimageSize(t *testing.T) {
+	for _, taproot := range []bool{false, true} {
+		params := GenTestParams()
+		if taproot {
+			params = genTaprootTestParams(nil)
+		}
+		// the test preimages are 32 bytes
+		params.Terms.PreimageSize = 32
+
+		t.Run(fmt.Sprintf("taproot=%t", taproot), func(t *testing.T) {
+			for _, path := range setupPaths {
+				signed, err := signLocally(&params, path)
+				assert.NoError(t, err, path.String())
+
+				unsigned, err := NewUnsignedSpend(&params, path)
+				assert.NoError(t, err)
+				// every hash lock checks the size first
+				disasm, err := txscript.DisasmString(unsigned.WitnessScript)
+				assert.NoError(t, err)
+				assert.Equal(t, strings.Count(disasm, "OP_HASH160"), strings.Count(disasm, "OP_SIZE 20 OP_EQUALVERIFY OP_HASH160"))
+
+				estimate, err := EstimateWitnessSize(&params.Terms, path)
+				assert.NoError(t, err)
+				assert.GreaterOrEqual(t, estimate, signed.Tx.TxIn[0].Witness.SerializeSize())
+			}
+
+			if !taproot {
+				deposit, _, err := BuildDepositContract(&params.Terms)
+				assert.NoError(t, err)
+				parsed, err := ParseDepositContract(deposit)
+				assert.NoError(t, err)
+				assert.Equal(t, 32, parsed.PreimageSize)
+				assert.False(t, parsed.Miniscript)
+				assert.NoError(t, CheckDepositContract(deposit, &params.Terms))
+			}
+		})
+	}
+
+	t.Run("wrong length", func(t *testing.T) {
+		params := GenTestParams()
+		params.Terms.PreimageSize = 33
+		// hash locks of preimages the script will refuse
+		assert.True(t, errors.Is(params.Alice.Check(&params.Terms), ErrSecretMismatch))
+
+		// the transaction is built from the public terms alone
+		public := params
+		public.Alice, public.Bob = nil, nil
+		spend, err := NewUnsignedSpend(&public, PathDepositAlice)
+		assert.NoError(t, err)
+		_, err = spend.SignAs(RoleAlice, params.Alice.PrivateKey)
+		assert.NoError(t, err)
+		_, err = spend.SignAs(RoleBob, params.Bob.PrivateKey)
+		assert.NoError(t, err)
+		_, err = spend.Finalize(params.Alice.PreA, params.Bob.PreB)
+		assert.True(t, errors.Is(err, ErrSecretMismatch))
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		params := GenTestParams()
+		params.Terms.PreimageSize = -1
+		assert.True(t, errors.Is(params.Terms.Validate(), ErrInvalidHashLock))
+
+		params.Terms.PreimageSize = 16
+		params.Terms.Miniscript = true
+		assert.True(t, errors.Is(params.Terms.Validate(), ErrInvalidHashLock))
+	})
+}
+
+func TestAbsoluteTimelocks(t *testing.T) {
+	for _, taproot := range []bool{false, true} {
+		for _, ellMode := range []TimelockMode{TimelockRelative, TimelockAbsolute} {
+			params := GenTestParams()
+			if taproot {
+				params = genTaprootTestParams(nil)
+			}
+			params.Terms.T, params.Terms.TMode = 2500000, TimelockAbsolute
+			if ellMode == TimelockAbsolute {
+				params.Terms.Ell, params.Terms.EllMode = 2500144, TimelockAbsolute
+			}
+
+			t.Run(fmt.Sprintf("taproot=%t ell %v", taproot, ellMode), func(t *testing.T) {
+				signed, err := signLocally(&params, PathDepositBob)
+				assert.NoError(t, err)
+				assert.Equal(t, uint32(2500000), signed.Tx.LockTime)
+				assert.Equal(t, uint32(wire.MaxTxInSequenceNum-1), signed.Tx.TxIn[0].Sequence)
+
+				signed, err = signLocally(&params, PathCollateralBob)
+				assert.NoError(t, err)
+				if ellMode == TimelockAbsolute {
+					assert.Equal(t, uint32(2500144), signed.Tx.LockTime)
+					assert.Equal(t, uint32(wire.MaxTxInSequenceNum-1), signed.Tx.TxIn[0].Sequence)
+				} else {
+					assert.Equal(t, uint32(0), signed.Tx.LockTime)
+					assert.Equal(t, uint32(params.Terms.Ell), signed.Tx.TxIn[0].Sequence)
+				}
+
+				for _, path := range []SpendPath{PathDepositAlice, PathCollateralMiner} {
+					_, err := signLocally(&params, path)
+					assert.NoError(t, err, path.String())
+				}
+
+				if !taproot {
+					deposit, _, err := BuildDepositContract(&params.Terms)
+					assert.NoError(t, err)
+					parsed, err := ParseDepositContract(deposit)
+					assert.NoError(t, err)
+					assert.Equal(t, TimelockAbsolute, parsed.TimelockMode)
+					assert.NoError(t, CheckDepositContract(deposit, &params.Terms))
+
+					collateral, _, err := BuildCollateralContract(&params.Terms)
+					assert.NoError(t, err)
+					assert.NoError(t, CheckCollateralContract(collateral, &params.Terms))
+				}
+			})
+		}
+	}
+
+	t.Run("lock time not reached", func(t *testing.T) {
+		params := GenTestParams()
+		params.Terms.T, params.Terms.TMode = 2500000, TimelockAbsolute
+		spend, err := NewUnsignedSpend(&params, PathDepositBob)
+		assert.NoError(t, err)
+		spend.Tx.LockTime--
+		_, err = spend.SignAs(RoleAlice, params.Alice.PrivateKey)
+		assert.NoError(t, err)
+		_, err = spend.SignAs(RoleBob, params.Bob.PrivateKey)
 		assert.NoError(t, err)
+		_, err = spend.Finalize(nil, params.Bob.PreB)
+		assert.True(t, errors.Is(err, ErrScriptVerify))
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		params := GenTestParams()
+		params.Terms.T, params.Terms.TMode = 2500000, TimelockAbsolute
+		params.Terms.Ell, params.Terms.EllMode = 2500000, TimelockAbsolute
+		assert.True(t, errors.Is(params.Terms.Validate(), ErrTimelockOutOfRange))
+
+		params = GenTestParams()
+		params.Terms.TMode = TimelockMode(5)
+		assert.True(t, errors.Is(params.Terms.Validate(), ErrTimelockOutOfRange))
+	})
+}
+
+func TestRelativeSeconds(t *testing.T) {
+	for _, taproot := range []bool{false, true} {
+		params := GenTestParams()
+		if taproot {
+			params = genTaprootTestParams(nil)
+		}
+		// an hour rounds up to 8 units of 512 seconds, ell stays in blocks
+		WithTimelockUnits(TimelockSeconds, TimelockBlocks)(&params)
+		params.Terms.T = 3600
+		seconds := uint32(wire.SequenceLockTimeIsSeconds | 8)
+
+		t.Run(fmt.Sprintf("taproot=%t", taproot), func(t *testing.T) {
+			signed, err := signLocally(&params, PathDepositBob)
+			assert.NoError(t, err)
+			assert.Equal(t, seconds, signed.Tx.TxIn[0].Sequence)
+
+			signed, err = signLocally(&params, PathCollateralBob)
+			assert.NoError(t, err)
+			assert.Equal(t, uint32(params.Terms.Ell), signed.Tx.TxIn[0].Sequence)
+
+			if !taproot {
+				deposit, _, err := BuildDepositContract(&params.Terms)
+				assert.NoError(t, err)
+				assert.Contains(t, mustDisasm(t, deposit), "080040 OP_CHECKSEQUENCEVERIFY")
+				parsed, err := ParseDepositContract(deposit)
+				assert.NoError(t, err)
+				assert.Equal(t, TimelockSeconds, parsed.TimelockUnit)
+				assert.Equal(t, int64(8*512), parsed.Timelock)
+				assert.NoError(t, CheckDepositContract(deposit, &params.Terms))
 
-		fmt.Println("[Col] spent by Miner", hex.EncodeToString(tx.Bytes()))
-		assert.Equal(t, params.expectedTxColMiner, hex.EncodeToString(tx.Bytes()))
+				other := params.Terms
+				other.TUnit = TimelockBlocks
+				assert.True(t, errors.Is(CheckDepositContract(deposit, &other), ErrTermsMismatch))
+				other = params.Terms
+				other.T = 4097
+				assert.True(t, errors.Is(CheckDepositContract(deposit, &other), ErrTermsMismatch))
+			}
+		})
+	}
+
+	t.Run("sequence too short", func(t *testing.T) {
+		params := GenTestParams()
+		params.Terms.T, params.Terms.TUnit = 3600, TimelockSeconds
+		spend, err := NewUnsignedSpend(&params, PathDepositBob)
+		assert.NoError(t, err)
+		spend.Tx.TxIn[0].Sequence--
+		_, err = spend.SignAs(RoleAlice, params.Alice.PrivateKey)
+		assert.NoError(t, err)
+		_, err = spend.SignAs(RoleBob, params.Bob.PrivateKey)
+		assert.NoError(t, err)
+		_, err = spend.Finalize(nil, params.Bob.PreB)
+		assert.True(t, errors.Is(err, ErrScriptVerify))
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		params := GenTestParams()
+		params.Terms.T, params.Terms.TUnit = MaxRelativeLockTime*512, TimelockSeconds
+		assert.NoError(t, params.Terms.Validate())
+		params.Terms.T++
+		assert.True(t, errors.Is(params.Terms.Validate(), ErrTimelockOutOfRange))
+
+		params = GenTestParams()
+		params.Terms.T, params.Terms.TMode = 2500000, TimelockAbsolute
+		params.Terms.TUnit = TimelockSeconds
+		assert.True(t, errors.Is(params.Terms.Validate(), ErrTimelockOutOfRange))
+
+		params = GenTestParams()
+		params.Terms.EllUnit = TimelockUnit(5)
+		assert.True(t, errors.Is(params.Terms.Validate(), ErrTimelockOutOfRange))
 	})
 }
+
+func mustDisasm(t *testing.T, script []byte) string {
+	disasm, err := txscript.DisasmString(script)
+	assert.NoError(t, err)
+	return disasm
+}
@@ -0,0 +1,285 @@
+package hehtlc
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/btcsuite/btcd/btcec/v2"
+	"github.com/btcsuite/btcd/btcec/v2/schnorr/musig2"
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+)
+
+// MuSig2AggregateKey returns the MuSig2 aggregate of Alice's and Bob's keys,
+// the default internal key of the taproot contracts. Keys are sorted, so both
+// parties compute the same aggregate.
+func MuSig2AggregateKey(terms *ContractTerms) (*btcec.PublicKey, error) {
+	if terms.AlicePubKey == nil || terms.BobPubKey == nil {
+		return nil, paramErrorf("InternalKey", ErrMissingValue, "MuSig2 needs both public keys")
+	}
+
+	aggregate, _, _, err := musig2.AggregateKeys(musig2SignerKeys(terms), true)
+	if err != nil {
+		return nil, err
+	}
+	return aggregate.PreTweakedKey, nil
+}
+
+func musig2SignerKeys(terms *ContractTerms) []*btcec.PublicKey {
+	return []*btcec.PublicKey{terms.AlicePubKey, terms.BobPubKey}
+}
+
+// CooperativeSession is one party's side of the MuSig2 signing of the
+// cooperative close: a key-path spend of the taproot deposit paying like
+// Dep-A. On chain it is an ordinary single-key spend.
+//
+// Each party creates a session on its own machine and sends PublicNonce to
+// the counterparty. Once the counterparty's nonce is added with AddNonce,
+// Sign returns the partial signature to send over. The counterparty's partial
+// signature is checked by AddPartialSignature, after which Finalize
+// aggregates both into the final signature.
+//
+// A session signs once: its secret nonce is erased by Sign.
+type CooperativeSession struct {
+	Tx     *wire.MsgTx
+	Amount int64
+
+	role     Role
+	key      *btcec.PrivateKey
+	terms    *ContractTerms
+	contract *TaprootContract
+	sigHash  [32]byte
+
+	nonces        *musig2.Nonces
+	theirNonce    *[musig2.PubNonceSize]byte
+	combinedNonce [musig2.PubNonceSize]byte
+
+	ourSig   *musig2.PartialSignature
+	theirSig *musig2.PartialSignature
+}
+
+// NewCooperativeSession starts the cooperative close of the deposit in params
+// as role, signing with key. The deposit must be a taproot contract whose
+// internal key is the MuSig2 aggregate of both parties' keys.
+func NewCooperativeSession(params *Parameters, role Role, key *btcutil.WIF) (*CooperativeSession, error) {
+	terms := &params.Terms
+	if !terms.Taproot {
+		return nil, paramErrorf("Taproot", ErrMissingValue, "the cooperative close needs a taproot deposit")
+	}
+	if key == nil {
+		return nil, &ParamError{Field: "PrivateKey", Err: ErrMissingValue}
+	}
+
+	aggregateKey, err := MuSig2AggregateKey(terms)
+	if err != nil {
+		return nil, err
+	}
+	contract, err := BuildTaprootDepositContract(terms)
+	if err != nil {
+		return nil, err
+	}
+	if !contract.InternalKey.IsEqual(aggregateKey) {
+		return nil, paramErrorf("InternalKey", ErrSecretMismatch, "not the MuSig2 aggregate of Alice's and Bob's keys")
+	}
+
+	session := &CooperativeSession{
+		role:     role,
+		terms:    terms,
+		contract: contract,
+	}
+	pubKey, err := terms.pubKey(role)
+	if err != nil {
+		return nil, err
+	}
+	if !key.PrivKey.PubKey().IsEqual(pubKey) {
+		return nil, fmt.Errorf("%w: key is not %v's contract key", ErrSecretMismatch, role)
+	}
+	session.key = key.PrivKey
+
+	session.Tx, session.Amount, err = unsignedDepositAlice(params, PathCooperative)
+	if err != nil {
+		return nil, err
+	}
+
+	prevOutput := txscript.NewCannedPrevOutputFetcher(contract.PkScript, session.Amount)
+	sigHashes := txscript.NewTxSigHashes(session.Tx, prevOutput)
+	sigHash, err := txscript.CalcTaprootSignatureHash(sigHashes, txscript.SigHashDefault, session.Tx, 0, prevOutput)
+	if err != nil {
+		return nil, err
+	}
+	copy(session.sigHash[:], sigHash)
+
+	session.nonces, err = musig2.GenNonces(
+		musig2.WithPublicKey(pubKey),
+		musig2.WithNonceSecretKeyAux(session.key),
+		musig2.WithNonceCombinedKeyAux(contract.OutputKey),
+		musig2.WithNonceMessageAux(session.sigHash),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return session, nil
+}
+
+// PublicNonce returns the public nonce to send to the counterparty.
+func (s *CooperativeSession) PublicNonce() [musig2.PubNonceSize]byte {
+	return s.nonces.PubNonce
+}
+
+// AddNonce adds the counterparty's public nonce.
+func (s *CooperativeSession) AddNonce(nonce [musig2.PubNonceSize]byte) error {
+	if s.theirNonce != nil {
+		return fmt.Errorf("hehtlc: %v's nonce was already added", s.role.counterparty())
+	}
+
+	combinedNonce, err := musig2.AggregateNonces(s.nonceOrder(s.nonces.PubNonce, nonce))
+	if err != nil {
+		return fmt.Errorf("%w: %v's nonce: %v", ErrInvalidSignature, s.role.counterparty(), err)
+	}
+
+	s.theirNonce = &nonce
+	s.combinedNonce = combinedNonce
+	return nil
+}
+
+// Sign returns our partial signature, to be sent to the counterparty.
+func (s *CooperativeSession) Sign() ([]byte, error) {
+	if s.theirNonce == nil {
+		return nil, fmt.Errorf("%w: %v's nonce is needed to sign", ErrMissingSignature, s.role.counterparty())
+	}
+	if s.ourSig != nil {
+		return nil, fmt.Errorf("hehtlc: cooperative session already signed, nonces cannot be reused")
+	}
+
+	sig, err := musig2.Sign(s.nonces.SecNonce, s.key, s.combinedNonce, musig2SignerKeys(s.terms),
+		s.sigHash, musig2.WithSortedKeys(), musig2.WithTaprootSignTweak(s.contract.MerkleRoot()))
+	if err != nil {
+		return nil, err
+	}
+	s.nonces.SecNonce = [musig2.SecNonceSize]byte{}
+	s.ourSig = sig
+
+	return encodePartialSignature(sig)
+}
+
+// VerifyPartialSignature checks that sig is the counterparty's valid partial
+// signature for this session. It can only be called after Sign, which fixes
+// the aggregate nonce both partial signatures share.
+func (s *CooperativeSession) VerifyPartialSignature(sig []byte) error {
+	_, err := s.verifyPartialSignature(sig)
+	return err
+}
+
+// AddPartialSignature verifies the counterparty's partial signature and keeps
+// it for Finalize.
+func (s *CooperativeSession) AddPartialSignature(sig []byte) error {
+	partialSig, err := s.verifyPartialSignature(sig)
+	if err != nil {
+		return err
+	}
+	s.theirSig = partialSig
+	return nil
+}
+
+// Finalize aggregates both partial signatures into the key-path witness,
+// checks the result with VerifySpend and returns the signed spend.
+func (s *CooperativeSession) Finalize() (*SignedSpend, error) {
+	if s.ourSig == nil || s.theirSig == nil {
+		return nil, fmt.Errorf("%w: %v needs both partial signatures", ErrMissingSignature, PathCooperative)
+	}
+
+	// the aggregate nonce R is the same in both partial signatures
+	sig := musig2.CombineSigs(s.ourSig.R, []*musig2.PartialSignature{s.ourSig, s.theirSig},
+		musig2.WithTaprootTweakedCombine(s.sigHash, musig2SignerKeys(s.terms), s.contract.MerkleRoot(), true))
+
+	tx := s.Tx.Copy()
+	tx.TxIn[0].Witness = wire.TxWitness{sig.Serialize()}
+
+	if err := VerifySpend(tx, txscript.NewCannedPrevOutputFetcher(s.contract.PkScript, s.Amount)); err != nil {
+		return nil, fmt.Errorf("hehtlc: %v: %w", PathCooperative, err)
+	}
+
+	return newSignedSpend(PathCooperative, tx, s.Amount)
+}
+
+func (s *CooperativeSession) verifyPartialSignature(sig []byte) (*musig2.PartialSignature, error) {
+	counterparty := s.role.counterparty()
+	if s.theirNonce == nil {
+		return nil, fmt.Errorf("%w: %v's nonce is needed to verify", ErrMissingSignature, counterparty)
+	}
+	if s.ourSig == nil {
+		return nil, fmt.Errorf("%w: sign before adding %v's partial signature", ErrMissingSignature, counterparty)
+	}
+
+	partialSig := &musig2.PartialSignature{R: s.ourSig.R}
+	if len(sig) != 32 || partialSig.Decode(bytes.NewReader(sig)) != nil {
+		return nil, fmt.Errorf("%w: %v's partial signature is malformed", ErrInvalidSignature, counterparty)
+	}
+
+	pubKey, err := s.terms.pubKey(counterparty)
+	if err != nil {
+		return nil, err
+	}
+	if !partialSig.Verify(*s.theirNonce, s.combinedNonce, musig2SignerKeys(s.terms), pubKey, s.sigHash,
+		musig2.WithSortedKeys(), musig2.WithTaprootSignTweak(s.contract.MerkleRoot())) {
+
+		return nil, fmt.Errorf("%w: %v's partial signature does not verify", ErrInvalidSignature, counterparty)
+	}
+
+	return partialSig, nil
+}
+
+// nonceOrder returns the public nonces of Alice and Bob, in that order.
+func (s *CooperativeSession) nonceOrder(ours, theirs [musig2.PubNonceSize]byte) [][musig2.PubNonceSize]byte {
+	if s.role == RoleAlice {
+		return [][musig2.PubNonceSize]byte{ours, theirs}
+	}
+	return [][musig2.PubNonceSize]byte{theirs, ours}
+}
+
+func encodePartialSignature(sig *musig2.PartialSignature) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := sig.Encode(&buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// SpendHeHTLCCooperative closes the taproot deposit through its key path,
+// paying vdep to Alice and vcol to Bob like Dep-A but without revealing preA
+// or any script. Both MuSig2 sessions run locally with the keys in params.
+func SpendHeHTLCCooperative(params *Parameters) (*SignedSpend, error) {
+	if err := checkSigners(params); err != nil {
+		return nil, err
+	}
+
+	alice, err := NewCooperativeSession(params, RoleAlice, params.Alice.PrivateKey)
+	if err != nil {
+		return nil, err
+	}
+	bob, err := NewCooperativeSession(params, RoleBob, params.Bob.PrivateKey)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := alice.AddNonce(bob.PublicNonce()); err != nil {
+		return nil, err
+	}
+	if err := bob.AddNonce(alice.PublicNonce()); err != nil {
+		return nil, err
+	}
+
+	if _, err := alice.Sign(); err != nil {
+		return nil, err
+	}
+	sigB, err := bob.Sign()
+	if err != nil {
+		return nil, err
+	}
+	if err := alice.AddPartialSignature(sigB); err != nil {
+		return nil, err
+	}
+
+	return alice.Finalize()
+}
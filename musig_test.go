@@ -0,0 +1,105 @@
+package hehtlc
+
+import (
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"math"
+	"testing"
+)
+
+func TestCooperativeSession(t *testing.T) {
+	params := genTaprootTestParams(nil)
+
+	// each party on its own machine
+	alice, err := NewCooperativeSession(&params, RoleAlice, params.Alice.PrivateKey)
+	assert.NoError(t, err)
+	bob, err := NewCooperativeSession(&params, RoleBob, params.Bob.PrivateKey)
+	assert.NoError(t, err)
+
+	assert.NoError(t, alice.AddNonce(bob.PublicNonce()))
+	assert.NoError(t, bob.AddNonce(alice.PublicNonce()))
+
+	sigA, err := alice.Sign()
+	assert.NoError(t, err)
+	sigB, err := bob.Sign()
+	assert.NoError(t, err)
+
+	// a partial signature only verifies as its signer's
+	assert.True(t, errors.Is(alice.VerifyPartialSignature(sigA), ErrInvalidSignature))
+	tampered := append([]byte{}, sigB...)
+	tampered[31] ^= 0x01
+	assert.True(t, errors.Is(alice.AddPartialSignature(tampered), ErrInvalidSignature))
+
+	assert.NoError(t, alice.AddPartialSignature(sigB))
+	assert.NoError(t, bob.AddPartialSignature(sigA))
+
+	signedByAlice, err := alice.Finalize()
+	assert.NoError(t, err)
+	signedByBob, err := bob.Finalize()
+	assert.NoError(t, err)
+	assert.Equal(t, signedByAlice.Hex, signedByBob.Hex)
+
+	// an ordinary key-path spend replacing Dep-A
+	witness := signedByAlice.Tx.TxIn[0].Witness
+	assert.Len(t, witness, 1)
+	assert.Len(t, witness[0], 64)
+
+	depositAlice, err := SpendHeHTLCDepositAlice(&params)
+	assert.NoError(t, err)
+	assert.Equal(t, depositAlice.TxID, signedByAlice.TxID)
+	assert.Less(t, signedByAlice.Weight, depositAlice.Weight)
+
+	p2wshParams := GenTestParams()
+	p2wshDepositAlice, err := SpendHeHTLCDepositAlice(&p2wshParams)
+	assert.NoError(t, err)
+	assert.Less(t, signedByAlice.Weight, p2wshDepositAlice.Weight)
+
+	t.Run("nonce reuse", func(t *testing.T) {
+		_, err := alice.Sign()
+		assert.Error(t, err)
+	})
+
+	t.Run("missing nonce", func(t *testing.T) {
+		session, err := NewCooperativeSession(&params, RoleAlice, params.Alice.PrivateKey)
+		assert.NoError(t, err)
+		_, err = session.Sign()
+		assert.True(t, errors.Is(err, ErrMissingSignature))
+	})
+
+	t.Run("wrong key", func(t *testing.T) {
+		_, err := NewCooperativeSession(&params, RoleAlice, params.Bob.PrivateKey)
+		assert.True(t, errors.Is(err, ErrSecretMismatch))
+
+		_, err = NewCooperativeSession(&params, RoleAlice, nil)
+		var paramErr *ParamError
+		assert.True(t, errors.As(err, &paramErr))
+		assert.Equal(t, "PrivateKey", paramErr.Field)
+		assert.True(t, errors.Is(err, ErrMissingValue))
+	})
+
+	t.Run("fee rate", func(t *testing.T) {
+		params := genTaprootTestParams(nil)
+		WithFeeRate(10)(&params)
+		// the key-path witness is sized, not the Dep-A leaf
+		signed, err := SpendHeHTLCCooperative(&params)
+		assert.NoError(t, err)
+		assert.Equal(t, int64(math.Ceil(10*float64(signed.VSize))), signed.Fee)
+		assert.GreaterOrEqual(t, signed.FeeRate, 10.0)
+		assert.Less(t, signed.FeeRate, 10.1)
+	})
+
+	t.Run("P2WSH deposit", func(t *testing.T) {
+		_, err := SpendHeHTLCCooperative(&p2wshParams)
+		assert.True(t, errors.Is(err, ErrMissingValue))
+	})
+}
+
+func TestSpendHeHTLCCooperative(t *testing.T) {
+	params := genTaprootTestParams(nil)
+
+	signed, err := SpendHeHTLCCooperative(&params)
+	assert.NoError(t, err)
+	assert.Equal(t, PathCooperative, signed.Path)
+	assert.Equal(t, params.Terms.VDep, signed.Tx.TxOut[0].Value)
+	assert.Equal(t, params.Terms.VCol, signed.Tx.TxOut[1].Value)
+}
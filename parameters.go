@@ -1,33 +1,47 @@
 package hehtlc
 
 import (
+	"fmt"
+	"github.com/btcsuite/btcd/btcec/v2"
 	"github.com/btcsuite/btcd/btcutil"
 	"github.com/btcsuite/btcd/chaincfg"
 	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/txscript"
 	"github.com/btcsuite/btcd/wire"
 )
 
 type Parameters struct {
-	preA []byte
-	preB []byte
+	// Terms are the public contract terms both parties agree on.
+	Terms ContractTerms
 
-	AlicePrivateKey *btcutil.WIF
-	BobPrivateKey   *btcutil.WIF
+	// Alice and Bob hold the per-party secrets. They are only needed to sign
+	// or to build a witness, and in a real swap each party only has its own.
+	Alice *AliceSecrets
+	Bob   *BobSecrets
 
 	Alice2Bech32Address string
 	Bob2Bech32Address   string
 
-	ell int64
-	T   int64
+	// FeeRate, in sat/vB, makes Dep-A, Dep-B and Col-B pay a fee matching
+	// their estimated size. Dep-A and Col-B take it out of the output of the
+	// party spending unless ChangeAddress takes what is left. When zero they
+	// pay the Fee of the terms. Col-M always pays vcol and the Fee reserved
+	// for it. Any other surplus goes to ChangeAddress or fails the spend
+	// with ErrAmountMismatch, unless the whole fee stays within an explicit
+	// MaxFee. MaxFee caps any fee, DefaultMaxFee if zero.
+	FeeRate       float64
+	MaxFee        int64
+	ChangeAddress string
 
-	vdep int64
-	vcol int64
-	fee  int64
+	// Anchors adds anchor outputs to every presigned transaction, paid like
+	// its outputs. Dep-B reserves those of Col-B or Col-M in the collateral,
+	// so Col-M still pays exactly vcol and the Fee.
+	Anchors AnchorType
 
-	depositUTXOForAlice    TestingUTXO
-	depositUTXOForBob      TestingUTXO
-	collateralUTXOForBob   TestingUTXO
-	collateralUTXOForMiner TestingUTXO
+	depositUTXOForAlice    fundingUTXO
+	depositUTXOForBob      fundingUTXO
+	collateralUTXOForBob   fundingUTXO
+	collateralUTXOForMiner fundingUTXO
 
 	expectedTxDepAlice string
 	expectedTxDepBob   string
@@ -35,12 +49,15 @@ type Parameters struct {
 	expectedTxColMiner string
 }
 
-type TestingUTXO struct {
+// fundingUTXO is an output funding a spend path, with the amount it holds.
+type fundingUTXO struct {
 	txid   string
 	utxo   uint32
 	amount int64
 }
 
+// GenTestParams returns the parameters of the testnet transactions in
+// hehtlc_test.go. It panics only if its hardcoded keys fail to decode.
 func GenTestParams() Parameters {
 	AlicePrivateKey, err := btcutil.DecodeWIF("cNnZ1uE6Eb3o2Ziuo2GBTNZxmjJqi3aoj4CHLkfm7as8Z9ruuRcE")
 	if err != nil {
@@ -52,38 +69,48 @@ func GenTestParams() Parameters {
 		panic(err)
 	}
 
+	preA := []byte("10a1e49e2c56295e1f2fd2dce78294da")
+	preB := []byte("0dc7c47740a748abed192062f0caf637")
+
 	params := Parameters{
-		preA:            []byte("10a1e49e2c56295e1f2fd2dce78294da"),
-		preB:            []byte("0dc7c47740a748abed192062f0caf637"),
-		AlicePrivateKey: AlicePrivateKey,
-		BobPrivateKey:   BobPrivateKey,
+		Terms: ContractTerms{
+			Net:         &chaincfg.TestNet3Params,
+			AlicePubKey: AlicePrivateKey.PrivKey.PubKey(),
+			BobPubKey:   BobPrivateKey.PrivKey.PubKey(),
+			HashA:       btcutil.Hash160(preA),
+			HashB:       btcutil.Hash160(preB),
+			T:           2, // set T and ell to be small values for testing purposes.
+			Ell:         2,
+			VCol:        25000,
+			VDep:        75000,
+			Fee:         500,
+		},
+		Alice: &AliceSecrets{PrivateKey: AlicePrivateKey, PreA: preA},
+		Bob:   &BobSecrets{PrivateKey: BobPrivateKey, PreB: preB},
 		// Bech32 testnet pubkey hash or script hash https://en.bitcoin.it/wiki/List_of_address_prefixes
 		Alice2Bech32Address: "tb1qklkpdy0xwcav7q4th97hnxncfd8l8kux4u7pwn",
 		Bob2Bech32Address:   "tb1qdd6cvu6krl6hyhzs2ylhsnul2plj3h330kgfz6",
-		T:                   2, // set T and ell to be small values for testing purposes.
-		ell:                 2,
-		vcol:                25000,
-		vdep:                75000,
-		fee:                 500,
+		// the testnet deposits leave up to half of their 200000 sats as fee
+		MaxFee: 100000,
 
-		depositUTXOForAlice: TestingUTXO{
+		depositUTXOForAlice: fundingUTXO{
 			txid:   "2717ebb6098623304b88e2b51f69e255229a8fc5e6cfd9dfa9e7f02f21721dd5",
 			utxo:   1,
 			amount: 200000,
 		},
 
-		depositUTXOForBob: TestingUTXO{
+		depositUTXOForBob: fundingUTXO{
 			txid:   "60f72390952124ba171bb464395fc5f82ebb5eb67767151955ec36c1085c3ac4",
 			utxo:   1,
 			amount: 200000,
 		},
 
-		collateralUTXOForBob: TestingUTXO{
+		collateralUTXOForBob: fundingUTXO{
 			txid:   "e80fcfb0a1ce936fcb9b514f03d2d78d4c8f06a0657e3a9f54411dee636d1ce6",
 			utxo:   0,
 			amount: 100500,
 		},
-		collateralUTXOForMiner: TestingUTXO{
+		collateralUTXOForMiner: fundingUTXO{
 			txid:   "af3952ff7ba660ee035e876a56bdaf577cada78b938c83a874ff34460cad6320",
 			utxo:   0,
 			amount: 100500,
@@ -98,54 +125,427 @@ func GenTestParams() Parameters {
 	return params
 }
 
-func (params *Parameters) GetAliceAddressOrPanic() btcutil.Address {
-	a, err := btcutil.DecodeAddress(params.Alice2Bech32Address, &chaincfg.TestNet3Params)
-	if err != nil {
-		panic(err)
+// MaxRelativeLockTime is the largest value that fits in the 16-bit BIP68
+// lock-time field of an input sequence number.
+// https://github.com/bitcoin/bips/blob/master/bip-0068.mediawiki
+const MaxRelativeLockTime = 0xffff
+
+// Option configures the Parameters returned by NewParameters.
+type Option func(*Parameters)
+
+// WithNetwork sets the network used to encode contract addresses and to
+// decode payout addresses.
+func WithNetwork(net *chaincfg.Params) Option {
+	return func(params *Parameters) {
+		params.Terms.Net = net
+	}
+}
+
+// WithTerms sets all contract terms at once, typically as received from the
+// counterparty. Options applied afterwards override individual terms.
+func WithTerms(terms ContractTerms) Option {
+	return func(params *Parameters) {
+		params.Terms = terms
+	}
+}
+
+// WithPubKeys sets the public keys of Alice and Bob.
+func WithPubKeys(alice, bob *btcec.PublicKey) Option {
+	return func(params *Parameters) {
+		params.Terms.AlicePubKey = alice
+		params.Terms.BobPubKey = bob
+	}
+}
+
+// WithHashLocks sets the hashes of preA and preB.
+func WithHashLocks(hashA, hashB []byte) Option {
+	return func(params *Parameters) {
+		params.Terms.HashA = hashA
+		params.Terms.HashB = hashB
+	}
+}
+
+// WithAliceSecrets sets Alice's private key and preA. Her public key and
+// hash lock are derived from them unless already set.
+func WithAliceSecrets(secrets *AliceSecrets) Option {
+	return func(params *Parameters) {
+		params.Alice = secrets
+	}
+}
+
+// WithBobSecrets sets Bob's private key and preB. His public key and hash
+// lock are derived from them unless already set.
+func WithBobSecrets(secrets *BobSecrets) Option {
+	return func(params *Parameters) {
+		params.Bob = secrets
+	}
+}
+
+// WithPayoutAddresses sets the addresses Alice and Bob are paid to.
+func WithPayoutAddresses(alice, bob string) Option {
+	return func(params *Parameters) {
+		params.Alice2Bech32Address = alice
+		params.Bob2Bech32Address = bob
+	}
+}
+
+// WithTimelocks sets the timelocks of the deposit (T) and of the collateral
+// (ell), relative in blocks unless WithTimelockModes and WithTimelockUnits
+// say otherwise.
+func WithTimelocks(T, ell int64) Option {
+	return func(params *Parameters) {
+		params.Terms.T = T
+		params.Terms.Ell = ell
+	}
+}
+
+// WithTimelockModes sets whether T and ell are relative or absolute.
+func WithTimelockModes(tMode, ellMode TimelockMode) Option {
+	return func(params *Parameters) {
+		params.Terms.TMode = tMode
+		params.Terms.EllMode = ellMode
+	}
+}
+
+// WithTimelockUnits sets whether T and ell count blocks or seconds. Relative
+// seconds are rounded up to the 512-second units of BIP68.
+func WithTimelockUnits(tUnit, ellUnit TimelockUnit) Option {
+	return func(params *Parameters) {
+		params.Terms.TUnit = tUnit
+		params.Terms.EllUnit = ellUnit
+	}
+}
+
+// WithAmounts sets vdep, vcol and the fee reserved for the collateral spend.
+func WithAmounts(vdep, vcol, fee int64) Option {
+	return func(params *Parameters) {
+		params.Terms.VDep = vdep
+		params.Terms.VCol = vcol
+		params.Terms.Fee = fee
+	}
+}
+
+// WithFeeRate makes the spends pay feeRate sat/vB.
+func WithFeeRate(feeRate float64) Option {
+	return func(params *Parameters) {
+		params.FeeRate = feeRate
+	}
+}
+
+// WithMaxFee sets the largest fee a spend may pay. Without a change address,
+// a spend may leave its surplus to the miner up to maxFee.
+func WithMaxFee(maxFee int64) Option {
+	return func(params *Parameters) {
+		params.MaxFee = maxFee
+	}
+}
+
+// WithChangeAddress sends what is left of each spend after its outputs and
+// fee to addr.
+func WithChangeAddress(addr string) Option {
+	return func(params *Parameters) {
+		params.ChangeAddress = addr
+	}
+}
+
+// WithAnchors adds anchor outputs of the given type to the presigned
+// transactions, so NewAnchorChild can bump their fee.
+func WithAnchors(anchors AnchorType) Option {
+	return func(params *Parameters) {
+		params.Anchors = anchors
+	}
+}
+
+// WithSigHash sets the sighash type both parties sign path with.
+func WithSigHash(path SpendPath, hashType txscript.SigHashType) Option {
+	return func(params *Parameters) {
+		if params.Terms.SigHashes == nil {
+			params.Terms.SigHashes = make(map[SpendPath]txscript.SigHashType)
+		}
+		params.Terms.SigHashes[path] = hashType
+	}
+}
+
+// WithTaproot switches both contracts to their taproot form. internalKey may
+// be nil to use the MuSig2 aggregate of Alice's and Bob's keys.
+func WithTaproot(internalKey *btcec.PublicKey) Option {
+	return func(params *Parameters) {
+		params.Terms.Taproot = true
+		params.Terms.InternalKey = internalKey
+	}
+}
+
+// WithScriptForm sets how the contracts check Alice's and Bob's signatures.
+func WithScriptForm(form ScriptForm) Option {
+	return func(params *Parameters) {
+		params.Terms.ScriptForm = form
+	}
+}
+
+// WithHashFunc sets the hash function of the hash locks. Hash locks derived
+// from the secrets of WithAliceSecrets and WithBobSecrets use it.
+func WithHashFunc(fn HashFunc) Option {
+	return func(params *Parameters) {
+		params.Terms.HashFunc = fn
 	}
-	return a
 }
 
-func (params *Parameters) GetBobAddressOrPanic() btcutil.Address {
-	a, err := btcutil.DecodeAddress(params.Bob2Bech32Address, &chaincfg.TestNet3Params)
+// WithPreimageSize makes every hash lock check that its preimage is exactly
+// size bytes.
+func WithPreimageSize(size int) Option {
+	return func(params *Parameters) {
+		params.Terms.PreimageSize = size
+	}
+}
+
+// WithMiniscript selects the miniscript-compatible encoding of the contracts,
+// which can be exported as output descriptors.
+func WithMiniscript() Option {
+	return func(params *Parameters) {
+		params.Terms.Miniscript = true
+	}
+}
+
+// WithDepositUTXO sets the outpoint and amount funding the deposit contract.
+func WithDepositUTXO(outpoint wire.OutPoint, amount int64) Option {
+	return func(params *Parameters) {
+		utxo := fundingUTXO{
+			txid:   outpoint.Hash.String(),
+			utxo:   outpoint.Index,
+			amount: amount,
+		}
+		params.depositUTXOForAlice = utxo
+		params.depositUTXOForBob = utxo
+	}
+}
+
+// WithCollateralUTXO sets the outpoint and amount funding the collateral
+// contract. It is only needed when the collateral was not funded by Dep-B;
+// otherwise the outpoint is derived from Dep-B.
+func WithCollateralUTXO(outpoint wire.OutPoint, amount int64) Option {
+	return func(params *Parameters) {
+		utxo := fundingUTXO{
+			txid:   outpoint.Hash.String(),
+			utxo:   outpoint.Index,
+			amount: amount,
+		}
+		params.collateralUTXOForBob = utxo
+		params.collateralUTXOForMiner = utxo
+	}
+}
+
+// NewParameters builds Parameters from opts and checks every invariant the
+// contracts rely on. A *ParamError is returned if any of them does not hold.
+func NewParameters(opts ...Option) (*Parameters, error) {
+	params := &Parameters{}
+	for _, opt := range opts {
+		opt(params)
+	}
+
+	// fill in the public side of whatever secrets we were given
+	terms := &params.Terms
+	if params.Alice != nil && params.Alice.PrivateKey != nil {
+		if terms.AlicePubKey == nil {
+			terms.AlicePubKey = params.Alice.PrivateKey.PrivKey.PubKey()
+		}
+		if terms.HashA == nil && len(params.Alice.PreA) > 0 {
+			terms.HashA = terms.HashFunc.Sum(params.Alice.PreA)
+		}
+	}
+	if params.Bob != nil && params.Bob.PrivateKey != nil {
+		if terms.BobPubKey == nil {
+			terms.BobPubKey = params.Bob.PrivateKey.PrivKey.PubKey()
+		}
+		if terms.HashB == nil && len(params.Bob.PreB) > 0 {
+			terms.HashB = terms.HashFunc.Sum(params.Bob.PreB)
+		}
+	}
+
+	if err := params.Validate(); err != nil {
+		return nil, err
+	}
+
+	return params, nil
+}
+
+// Validate checks that params describe a well-formed He-HTLC: the contract
+// terms are valid, payout addresses belong to the contract network, every
+// funding input covers the outputs of the transactions spending it and any
+// secrets present match the terms.
+func (params *Parameters) Validate() error {
+	terms := &params.Terms
+	if err := terms.Validate(); err != nil {
+		return err
+	}
+
+	switch {
+	case params.FeeRate < 0:
+		return paramErrorf("FeeRate", ErrNonPositiveAmount, "got %v", params.FeeRate)
+	case params.MaxFee < 0:
+		return paramErrorf("MaxFee", ErrNonPositiveAmount, "got %d", params.MaxFee)
+	}
+	if _, err := anchorOutputs(params); err != nil {
+		return err
+	}
+
+	addresses := []struct {
+		field string
+		addr  string
+	}{
+		{"Alice2Bech32Address", params.Alice2Bech32Address},
+		{"Bob2Bech32Address", params.Bob2Bech32Address},
+		{"ChangeAddress", params.ChangeAddress},
+	}
+	for _, a := range addresses {
+		if a.addr == "" && a.field == "ChangeAddress" {
+			continue
+		}
+		if a.addr == "" {
+			return &ParamError{Field: a.field, Err: ErrMissingValue}
+		}
+		if _, err := decodeAddress(a.addr, terms.Net); err != nil {
+			return &ParamError{Field: a.field, Err: err}
+		}
+	}
+
+	// each funding input must cover the outputs of the path spending it and,
+	// unless a FeeRate sizes it later, its fee. Dep-B's output is itself
+	// the collateral, which reserves the Fee and anchors of Col-B or Col-M
+	// on top of Dep-B's own.
+	anchors := params.anchorValue()
+	var fee int64
+	if params.FeeRate == 0 {
+		fee = terms.Fee
+	}
+	inputs := []struct {
+		field   string
+		utxo    fundingUTXO
+		outputs int64
+		// the collateral outpoint is derived from Dep-B when not set
+		derived bool
+	}{
+		{"depositUTXOForAlice", params.depositUTXOForAlice, terms.VDep + terms.VCol + fee + anchors, false},
+		{"depositUTXOForBob", params.depositUTXOForBob, terms.VDep + terms.VCol + terms.Fee + fee + 2*anchors, false},
+		{"collateralUTXOForBob", params.collateralUTXOForBob, terms.VDep + terms.VCol + fee + anchors, true},
+		{"collateralUTXOForMiner", params.collateralUTXOForMiner, terms.VDep + terms.VCol + terms.Fee + anchors, true},
+	}
+	for _, in := range inputs {
+		if in.utxo.txid == "" && in.derived {
+			continue
+		}
+		if in.utxo.txid == "" {
+			return &ParamError{Field: in.field, Err: ErrMissingValue}
+		}
+		if _, err := in.utxo.outPoint(); err != nil {
+			return &ParamError{Field: in.field, Err: err}
+		}
+		if in.utxo.amount < in.outputs {
+			return paramErrorf(in.field, ErrAmountMismatch,
+				"input %d < outputs %d", in.utxo.amount, in.outputs)
+		}
+	}
+
+	if params.Alice != nil {
+		if err := params.Alice.Check(terms); err != nil {
+			return err
+		}
+	}
+	if params.Bob != nil {
+		if err := params.Bob.Check(terms); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// decodeAddress decodes addr and makes sure it belongs to net. btcutil
+// accepts any known bech32 prefix regardless of the network it is given, so
+// the network has to be checked separately.
+func decodeAddress(addr string, net *chaincfg.Params) (btcutil.Address, error) {
+	a, err := btcutil.DecodeAddress(addr, net)
 	if err != nil {
-		panic(err)
+		return nil, fmt.Errorf("%w: %s: %v", ErrInvalidAddress, addr, err)
+	}
+	if !a.IsForNet(net) {
+		return nil, fmt.Errorf("%w: %s is not a %s address", ErrWrongNetwork, addr, net.Name)
 	}
-	return a
+	return a, nil
+}
+
+func (params *Parameters) GetAliceAddress() (btcutil.Address, error) {
+	return decodeAddress(params.Alice2Bech32Address, params.Terms.Net)
+}
+
+func (params *Parameters) GetBobAddress() (btcutil.Address, error) {
+	return decodeAddress(params.Bob2Bech32Address, params.Terms.Net)
+}
+
+func (params *Parameters) GetDepositUTXO4Alice() (*wire.OutPoint, error) {
+	return params.depositUTXOForAlice.outPoint()
+}
+
+func (params *Parameters) GetDepositUTXOForBob() (*wire.OutPoint, error) {
+	return params.depositUTXOForBob.outPoint()
 }
 
-func (params *Parameters) GetDepositUTXO4Alice() *wire.OutPoint {
-	utxoHash, err := chainhash.NewHashFromStr(params.depositUTXOForAlice.txid)
+func (params *Parameters) GetCollateralUTXOForBob() (*wire.OutPoint, error) {
+	utxo, err := params.collateralUTXO(params.collateralUTXOForBob)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
-	return wire.NewOutPoint(utxoHash, params.depositUTXOForAlice.utxo)
+	return utxo.outPoint()
 }
 
-func (params *Parameters) GetDepositUTXOForBob() *wire.OutPoint {
-	utxoHash, err := chainhash.NewHashFromStr(params.depositUTXOForBob.txid)
+func (params *Parameters) GetCollateralUTXOForMiner() (*wire.OutPoint, error) {
+	utxo, err := params.collateralUTXO(params.collateralUTXOForMiner)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
-	return wire.NewOutPoint(utxoHash, params.depositUTXOForBob.utxo)
+	return utxo.outPoint()
 }
 
-func (params *Parameters) GetCollateralUTXOForBob() *wire.OutPoint {
-	utxoHash, err := chainhash.NewHashFromStr(params.collateralUTXOForBob.txid)
+// DeriveCollateralUTXO sets the collateral outpoint and amount to the output
+// of Dep-B, so Col-B and Col-M can be built and presigned before anything is
+// broadcast.
+func (params *Parameters) DeriveCollateralUTXO() error {
+	utxo, err := params.collateralUTXO(fundingUTXO{})
 	if err != nil {
-		panic(err)
+		return err
 	}
-	return wire.NewOutPoint(utxoHash, params.collateralUTXOForBob.utxo)
+	params.collateralUTXOForBob = utxo
+	params.collateralUTXOForMiner = utxo
+	return nil
 }
 
-func (params *Parameters) GetCollateralUTXOForMiner() *wire.OutPoint {
-	utxoHash, err := chainhash.NewHashFromStr(params.collateralUTXOForMiner.txid)
+// collateralUTXO returns utxo, or the collateral output of Dep-B if utxo was
+// never set.
+func (params *Parameters) collateralUTXO(utxo fundingUTXO) (fundingUTXO, error) {
+	if utxo.txid != "" {
+		return utxo, nil
+	}
+
+	txDepBob, _, err := unsignedDepositBob(params)
 	if err != nil {
-		panic(err)
+		return fundingUTXO{}, err
+	}
+
+	outpoint, amount, err := CollateralUTXOFromDepositBob(txDepBob, &params.Terms)
+	if err != nil {
+		return fundingUTXO{}, err
 	}
-	return wire.NewOutPoint(utxoHash, params.collateralUTXOForMiner.utxo)
+
+	return fundingUTXO{
+		txid:   outpoint.Hash.String(),
+		utxo:   outpoint.Index,
+		amount: amount,
+	}, nil
 }
 
-func (params *Parameters) GetAliceBobPks() ([]byte, []byte) {
-	return params.AlicePrivateKey.PrivKey.PubKey().SerializeCompressed(), params.BobPrivateKey.PrivKey.PubKey().SerializeCompressed()
+func (utxo fundingUTXO) outPoint() (*wire.OutPoint, error) {
+	utxoHash, err := chainhash.NewHashFromStr(utxo.txid)
+	if err != nil {
+		return nil, fmt.Errorf("%w: txid %q: %v", ErrBadOutpoint, utxo.txid, err)
+	}
+	return wire.NewOutPoint(utxoHash, utxo.utxo), nil
 }
@@ -0,0 +1,124 @@
+package hehtlc
+
+import (
+	"errors"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func testOptions(t *testing.T) []Option {
+	params := GenTestParams()
+
+	depHash, err := chainhash.NewHashFromStr(params.depositUTXOForBob.txid)
+	assert.NoError(t, err)
+	colHash, err := chainhash.NewHashFromStr(params.collateralUTXOForBob.txid)
+	assert.NoError(t, err)
+
+	return []Option{
+		WithNetwork(&chaincfg.TestNet3Params),
+		WithAliceSecrets(params.Alice),
+		WithBobSecrets(params.Bob),
+		WithPayoutAddresses(params.Alice2Bech32Address, params.Bob2Bech32Address),
+		WithTimelocks(params.Terms.T, params.Terms.Ell),
+		WithAmounts(params.Terms.VDep, params.Terms.VCol, params.Terms.Fee),
+		WithDepositUTXO(*wire.NewOutPoint(depHash, 1), 200000),
+		WithCollateralUTXO(*wire.NewOutPoint(colHash, 0), 100500),
+		WithMaxFee(params.MaxFee),
+	}
+}
+
+func TestNewParameters(t *testing.T) {
+	testParams := GenTestParams()
+	assert.NoError(t, testParams.Validate())
+
+	t.Run("public terms only", func(t *testing.T) {
+		params, err := NewParameters(append(testOptions(t),
+			WithAliceSecrets(nil),
+			WithBobSecrets(nil),
+			WithTerms(testParams.Terms),
+		)...)
+		assert.NoError(t, err)
+		assert.Nil(t, params.Alice)
+
+		_, err = SpendHeHTLCDepositBob(params)
+		assert.True(t, errors.Is(err, ErrMissingSecret))
+	})
+
+	t.Run("valid", func(t *testing.T) {
+		params, err := NewParameters(testOptions(t)...)
+		assert.NoError(t, err)
+		assert.Equal(t, testParams.Terms, params.Terms)
+		assert.Equal(t, testParams.depositUTXOForBob, params.depositUTXOForBob)
+		assert.Equal(t, testParams.collateralUTXOForBob, params.collateralUTXOForBob)
+	})
+
+	invalid := []struct {
+		name  string
+		opt   Option
+		field string
+		err   error
+	}{
+		{"missing network", WithNetwork(nil), "Net", ErrMissingValue},
+		{"mainnet address on testnet", WithPayoutAddresses(testParams.Alice2Bech32Address, "bc1qw508d6qejxtdg4y5r3zarvary0c5xw7kv8f3t4"), "Bob2Bech32Address", ErrWrongNetwork},
+		{"missing keys", WithBobSecrets(nil), "BobPubKey", ErrMissingValue},
+		{"wrong preimage", func(params *Parameters) {
+			WithTerms(testParams.Terms)(params)
+			WithAliceSecrets(&AliceSecrets{PrivateKey: testParams.Alice.PrivateKey, PreA: testParams.Bob.PreB})(params)
+		}, "Alice.PreA", ErrSecretMismatch},
+		{"short hash lock", WithHashLocks(testParams.Terms.HashA, testParams.Terms.HashB[:19]), "HashB", ErrInvalidHashLock},
+		{"zero vdep", WithAmounts(0, 25000, 500), "VDep", ErrNonPositiveAmount},
+		{"negative fee", WithAmounts(75000, 25000, -1), "Fee", ErrNonPositiveAmount},
+		{"zero T", WithTimelocks(0, 2), "T", ErrTimelockOutOfRange},
+		{"ell too large", WithTimelocks(2, MaxRelativeLockTime+1), "Ell", ErrTimelockOutOfRange},
+		{"bad address", WithPayoutAddresses("tb1qnotanaddress", testParams.Bob2Bech32Address), "Alice2Bech32Address", ErrInvalidAddress},
+		{"deposit too small", WithDepositUTXO(wire.OutPoint{Index: 1}, 100999), "depositUTXOForBob", ErrAmountMismatch},
+		{"collateral too small", WithCollateralUTXO(wire.OutPoint{}, 99999), "collateralUTXOForBob", ErrAmountMismatch},
+	}
+	// Dep-B pays its own anchors and those of the collateral spends
+	for _, anchors := range []AnchorType{AnchorKeyed, AnchorEphemeral} {
+		t.Run(anchors.String(), func(t *testing.T) {
+			perTx := int64(EphemeralAnchorValue)
+			if anchors == AnchorKeyed {
+				perTx = 2 * KeyedAnchorValue
+			}
+			deposit := testParams.Terms.VDep + testParams.Terms.VCol + 2*testParams.Terms.Fee + 2*perTx
+			opts := append(testOptions(t),
+				WithAnchors(anchors),
+				WithCollateralUTXO(wire.OutPoint{}, 100500+perTx),
+			)
+
+			params, err := NewParameters(append(opts, WithDepositUTXO(wire.OutPoint{Index: 1}, deposit))...)
+			assert.NoError(t, err)
+			_, err = NewUnsignedSpend(params, PathDepositBob)
+			assert.NoError(t, err)
+
+			// one anchor output short
+			short := deposit - EphemeralAnchorValue
+			if anchors == AnchorKeyed {
+				short = deposit - KeyedAnchorValue
+			}
+			_, err = NewParameters(append(opts, WithDepositUTXO(wire.OutPoint{Index: 1}, short))...)
+			assert.True(t, errors.Is(err, ErrAmountMismatch), "got %v", err)
+			var paramErr *ParamError
+			if assert.True(t, errors.As(err, &paramErr)) {
+				assert.Equal(t, "depositUTXOForBob", paramErr.Field)
+			}
+		})
+	}
+
+	for _, tc := range invalid {
+		t.Run(tc.name, func(t *testing.T) {
+			params, err := NewParameters(append(testOptions(t), tc.opt)...)
+			assert.Nil(t, params)
+			assert.True(t, errors.Is(err, tc.err), "got %v", err)
+
+			var paramErr *ParamError
+			if assert.True(t, errors.As(err, &paramErr)) {
+				assert.Equal(t, tc.field, paramErr.Field)
+			}
+		})
+	}
+}
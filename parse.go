@@ -0,0 +1,388 @@
+package hehtlc
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/btcsuite/btcd/btcec/v2"
+	"github.com/btcsuite/btcd/btcec/v2/schnorr"
+	"github.com/btcsuite/btcd/txscript"
+)
+
+// ContractScript is what a P2WSH deposit or collateral script commits to.
+type ContractScript struct {
+	AlicePubKey *btcec.PublicKey
+	BobPubKey   *btcec.PublicKey
+	HashA       []byte
+	HashB       []byte
+	HashFunc    HashFunc
+
+	// Timelock is T for a deposit and ell for a collateral. A relative
+	// timelock in seconds is a multiple of 512, as BIP68 encodes it.
+	Timelock     int64
+	TimelockMode TimelockMode
+	TimelockUnit TimelockUnit
+
+	// PreimageSize is the preimage length the hash locks check, 0 if they
+	// accept any.
+	PreimageSize int
+
+	ScriptForm ScriptForm
+	Miniscript bool
+}
+
+// ParseDepositContract is the reverse of BuildDepositContract: it returns the
+// keys, hash locks and T of a deposit witness script. A script deviating
+// from the template fails with ErrNotHeHTLC, naming the first opcode that
+// differs.
+func ParseDepositContract(witnessScript []byte) (*ContractScript, error) {
+	return parseContract(witnessScript, depositWitnessScript)
+}
+
+// ParseCollateralContract is the reverse of BuildCollateralContract: it
+// returns the keys, hash locks and ell of a collateral witness script. A
+// script deviating from the template fails with ErrNotHeHTLC, naming the
+// first opcode that differs.
+func ParseCollateralContract(witnessScript []byte) (*ContractScript, error) {
+	return parseContract(witnessScript, collateralWitnessScript)
+}
+
+// CheckDepositContract parses a deposit witness script and makes sure it
+// commits to terms, which are validated first.
+func CheckDepositContract(witnessScript []byte, terms *ContractTerms) error {
+	if err := terms.Validate(); err != nil {
+		return err
+	}
+	parsed, err := ParseDepositContract(witnessScript)
+	if err != nil {
+		return err
+	}
+	return parsed.check(terms, "T", terms.T, terms.TMode, terms.TUnit)
+}
+
+// CheckCollateralContract parses a collateral witness script and makes sure
+// it commits to terms, which are validated first.
+func CheckCollateralContract(witnessScript []byte, terms *ContractTerms) error {
+	if err := terms.Validate(); err != nil {
+		return err
+	}
+	parsed, err := ParseCollateralContract(witnessScript)
+	if err != nil {
+		return err
+	}
+	return parsed.check(terms, "Ell", terms.Ell, terms.EllMode, terms.EllUnit)
+}
+
+func (c *ContractScript) check(terms *ContractTerms, timelockField string, timelock int64,
+	mode TimelockMode, unit TimelockUnit) error {
+
+	if terms.Taproot {
+		return paramErrorf("Taproot", ErrTermsMismatch, "a witness script is a P2WSH contract")
+	}
+
+	switch {
+	case !c.AlicePubKey.IsEqual(terms.AlicePubKey):
+		return paramErrorf("AlicePubKey", ErrTermsMismatch, "script has %x",
+			c.AlicePubKey.SerializeCompressed())
+	case !c.BobPubKey.IsEqual(terms.BobPubKey):
+		return paramErrorf("BobPubKey", ErrTermsMismatch, "script has %x",
+			c.BobPubKey.SerializeCompressed())
+	case !bytes.Equal(c.HashA, terms.HashA):
+		return paramErrorf("HashA", ErrTermsMismatch, "script has %x", c.HashA)
+	case !bytes.Equal(c.HashB, terms.HashB):
+		return paramErrorf("HashB", ErrTermsMismatch, "script has %x", c.HashB)
+	case c.HashFunc != terms.HashFunc:
+		return paramErrorf("HashFunc", ErrTermsMismatch, "script has %v", c.HashFunc)
+	case c.TimelockMode != mode:
+		return paramErrorf(timelockField+"Mode", ErrTermsMismatch, "script has %v", c.TimelockMode)
+	case c.TimelockUnit != unit:
+		return paramErrorf(timelockField+"Unit", ErrTermsMismatch, "script has %v", c.TimelockUnit)
+	case encodeTimelock(c.Timelock, mode, unit) != encodeTimelock(timelock, mode, unit):
+		// seconds are compared as rounded into the script
+		return paramErrorf(timelockField, ErrTermsMismatch, "script has %d", c.Timelock)
+	case c.ScriptForm != terms.signatureForm():
+		return paramErrorf("ScriptForm", ErrTermsMismatch, "script has %v", c.ScriptForm)
+	case c.Miniscript != terms.Miniscript:
+		return paramErrorf("Miniscript", ErrTermsMismatch, "script has %t", c.Miniscript)
+	case c.PreimageSize != terms.preimageSize():
+		return paramErrorf("PreimageSize", ErrTermsMismatch, "script has %d", c.PreimageSize)
+	}
+	return nil
+}
+
+// scriptToken is one opcode of a script with its data and raw encoding.
+type scriptToken struct {
+	opcode byte
+	data   []byte
+	raw    []byte
+}
+
+func (tok scriptToken) String() string {
+	disasm, err := txscript.DisasmString(tok.raw)
+	if err != nil {
+		return fmt.Sprintf("%x", tok.raw)
+	}
+	return disasm
+}
+
+func tokenizeScript(script []byte) ([]scriptToken, error) {
+	var tokens []scriptToken
+	tokenizer := txscript.MakeScriptTokenizer(0, script)
+	start := int32(0)
+	for tokenizer.Next() {
+		end := tokenizer.ByteIndex()
+		tokens = append(tokens, scriptToken{
+			opcode: tokenizer.Opcode(),
+			data:   tokenizer.Data(),
+			raw:    script[start:end],
+		})
+		start = end
+	}
+	if err := tokenizer.Err(); err != nil {
+		return nil, fmt.Errorf("%w: opcode %d: %v", ErrNotHeHTLC, len(tokens), err)
+	}
+	return tokens, nil
+}
+
+// parseContract reads the terms out of witnessScript where build puts them,
+// then rebuilds the script from them: any opcode that differs from the
+// template shows up in the comparison.
+func parseContract(witnessScript []byte,
+	build func(*ContractTerms) ([]byte, error)) (*ContractScript, error) {
+
+	tokens, err := tokenizeScript(witnessScript)
+	if err != nil {
+		return nil, err
+	}
+	terms, hashes, err := extractTerms(tokens, false)
+	if err != nil {
+		return nil, err
+	}
+
+	// placeholders for missing hash locks make the comparison report them
+	for len(hashes) < 2 {
+		hashes = append(hashes, make([]byte, terms.HashFunc.Size()))
+	}
+	terms.HashA, terms.HashB = hashes[0], hashes[1]
+
+	expected, err := build(terms)
+	if err != nil {
+		return nil, err
+	}
+	if err := compareScripts(tokens, expected); err != nil {
+		return nil, err
+	}
+	if err := checkTimelock("Timelock", terms.T, terms.TMode, terms.TUnit); err != nil {
+		return nil, err
+	}
+
+	return &ContractScript{
+		AlicePubKey:  terms.AlicePubKey,
+		BobPubKey:    terms.BobPubKey,
+		HashA:        terms.HashA,
+		HashB:        terms.HashB,
+		HashFunc:     terms.HashFunc,
+		Timelock:     terms.T,
+		TimelockMode: terms.TMode,
+		TimelockUnit: terms.TUnit,
+		PreimageSize: terms.PreimageSize,
+		ScriptForm:   terms.ScriptForm,
+		Miniscript:   terms.Miniscript,
+	}, nil
+}
+
+// parseTaprootLeaf returns the spend path of a leaf of the taproot contracts
+// and the terms it commits to. Fields the leaf does not commit to are left
+// empty.
+func parseTaprootLeaf(leafScript []byte) (SpendPath, *ContractTerms, error) {
+	tokens, err := tokenizeScript(leafScript)
+	if err != nil {
+		return 0, nil, err
+	}
+	terms, hashes, err := extractTerms(tokens, true)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	// each leaf has its own number of hash locks and timelocks
+	hasTimelock := terms.T != 0
+	var path SpendPath
+	switch {
+	case len(hashes) >= 2:
+		path = PathCollateralMiner
+		terms.HashA, terms.HashB = hashes[0], hashes[1]
+		terms.T, terms.Ell = 0, 0
+	case len(hashes) == 1 && hasTimelock:
+		path = PathDepositBob
+		terms.HashB = hashes[0]
+		terms.Ell = 0
+	case len(hashes) == 1:
+		path = PathDepositAlice
+		terms.HashA = hashes[0]
+	default:
+		path = PathCollateralBob
+		terms.T = 0
+	}
+
+	expected, err := taprootLeafScript(terms, path)
+	if err != nil {
+		return 0, nil, err
+	}
+	if err := compareScripts(tokens, expected); err != nil {
+		return 0, nil, err
+	}
+	if hasTimelock {
+		if err := checkTimelock("Timelock", terms.T+terms.Ell, terms.TMode, terms.TUnit); err != nil {
+			return 0, nil, err
+		}
+	}
+
+	return path, terms, nil
+}
+
+// extractTerms reads the keys, script form, encoding, hash function and
+// preimage size of a contract script, the hash locks in the order they appear
+// and its decoded timelock, which is set as both T and Ell.
+func extractTerms(tokens []scriptToken, taproot bool) (*ContractTerms, [][]byte, error) {
+	if len(tokens) == 0 {
+		return nil, nil, fmt.Errorf("%w: empty script", ErrNotHeHTLC)
+	}
+
+	terms := &ContractTerms{Taproot: taproot, ScriptForm: ScriptFormCheckSig}
+	// the miniscript encoding of the P2WSH contracts opens its first branch
+	// before the signature check
+	start := 0
+	if !taproot && tokens[0].opcode == txscript.OP_IF {
+		terms.Miniscript = true
+		start = 1
+	}
+	keyIndexes := []int{start, start + 2}
+	switch {
+	case !taproot && len(tokens) > start && tokens[start].opcode == txscript.OP_2:
+		terms.ScriptForm = ScriptFormMultisig
+		keyIndexes = []int{start + 1, start + 2}
+	case taproot && len(tokens) > 3 && tokens[3].opcode == txscript.OP_CHECKSIGADD:
+		terms.ScriptForm = ScriptFormCheckSigAdd
+	}
+
+	keys := make([]*btcec.PublicKey, len(keyIndexes))
+	for i, index := range keyIndexes {
+		if index >= len(tokens) {
+			return nil, nil, fmt.Errorf("%w: opcode %d: expected a public key, got end of script", ErrNotHeHTLC, index)
+		}
+		key, err := parseScriptKey(tokens[index].data, taproot)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%w: opcode %d: expected a %s, got %v",
+				ErrNotHeHTLC, index, err, tokens[index])
+		}
+		keys[i] = key
+	}
+	terms.AlicePubKey, terms.BobPubKey = keys[0], keys[1]
+
+	var hashes [][]byte
+	for i, tok := range tokens {
+		switch tok.opcode {
+		case txscript.OP_SIZE:
+			if i+1 < len(tokens) && terms.PreimageSize == 0 {
+				size, _ := scriptNumber(tokens[i+1])
+				terms.PreimageSize = int(size)
+			}
+		case txscript.OP_HASH160, txscript.OP_SHA256, txscript.OP_HASH256:
+			hashFunc := hashFuncOf(tok.opcode)
+			if len(hashes) == 0 {
+				// the first hash lock sets the function the rest must use
+				terms.HashFunc = hashFunc
+			}
+			if hashFunc == terms.HashFunc && i+1 < len(tokens) && len(tokens[i+1].data) == hashFunc.Size() {
+				hashes = append(hashes, tokens[i+1].data)
+			}
+		case txscript.OP_CHECKSEQUENCEVERIFY, txscript.OP_CHECKLOCKTIMEVERIFY:
+			if i > 0 && terms.T == 0 {
+				encoded, _ := scriptNumber(tokens[i-1])
+				if tok.opcode == txscript.OP_CHECKLOCKTIMEVERIFY {
+					terms.TMode = TimelockAbsolute
+				}
+				terms.T, terms.TUnit = decodeTimelock(encoded, terms.TMode)
+			}
+		}
+	}
+	terms.Ell, terms.EllMode, terms.EllUnit = terms.T, terms.TMode, terms.TUnit
+
+	return terms, hashes, nil
+}
+
+func hashFuncOf(opcode byte) HashFunc {
+	switch opcode {
+	case txscript.OP_SHA256:
+		return HashFuncSHA256
+	case txscript.OP_HASH256:
+		return HashFuncHash256
+	default:
+		return HashFuncHash160
+	}
+}
+
+// parseScriptKey parses a compressed key, or an x-only one in tapscript. Its
+// error names the expected key.
+func parseScriptKey(data []byte, taproot bool) (*btcec.PublicKey, error) {
+	if taproot {
+		key, err := schnorr.ParsePubKey(data)
+		if err != nil {
+			return nil, errors.New("x-only public key")
+		}
+		return key, nil
+	}
+
+	key, err := btcec.ParsePubKey(data)
+	if err != nil || len(data) != btcec.PubKeyBytesLenCompressed {
+		return nil, errors.New("compressed public key")
+	}
+	return key, nil
+}
+
+// compareScripts reports the first opcode of tokens that differs from
+// expected.
+func compareScripts(tokens []scriptToken, expected []byte) error {
+	expectedTokens, err := tokenizeScript(expected)
+	if err != nil {
+		return err
+	}
+
+	for i, want := range expectedTokens {
+		if i >= len(tokens) {
+			return fmt.Errorf("%w: opcode %d: expected %v, got end of script", ErrNotHeHTLC, i, want)
+		}
+		if !bytes.Equal(tokens[i].raw, want.raw) {
+			return fmt.Errorf("%w: opcode %d: expected %v, got %v", ErrNotHeHTLC, i, want, tokens[i])
+		}
+	}
+	if len(tokens) > len(expectedTokens) {
+		i := len(expectedTokens)
+		return fmt.Errorf("%w: opcode %d: expected end of script, got %v", ErrNotHeHTLC, i, tokens[i])
+	}
+	return nil
+}
+
+// scriptNumber decodes a minimally pushed number of up to 5 bytes, as
+// OP_CHECKSEQUENCEVERIFY and OP_CHECKLOCKTIMEVERIFY read it.
+func scriptNumber(tok scriptToken) (int64, bool) {
+	switch {
+	case tok.opcode == txscript.OP_0:
+		return 0, true
+	case tok.opcode >= txscript.OP_1 && tok.opcode <= txscript.OP_16:
+		return int64(tok.opcode - (txscript.OP_1 - 1)), true
+	case tok.data == nil || len(tok.data) > 5:
+		return 0, false
+	}
+
+	var n int64
+	for i, b := range tok.data {
+		n |= int64(b) << uint(8*i)
+	}
+	last := tok.data[len(tok.data)-1]
+	if last&0x80 != 0 {
+		n &^= int64(0x80) << uint(8*(len(tok.data)-1))
+		n = -n
+	}
+	return n, true
+}
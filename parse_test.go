@@ -0,0 +1,106 @@
+package hehtlc
+
+import (
+	"bytes"
+	"errors"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestParseContracts(t *testing.T) {
+	for _, form := range []ScriptForm{ScriptFormMultisig, ScriptFormCheckSig} {
+		for _, miniscript := range []bool{false, true} {
+			params := GenTestParams()
+			params.Terms.ScriptForm = form
+			params.Terms.Miniscript = miniscript
+			terms := &params.Terms
+
+			name := form.String()
+			if miniscript {
+				name += " miniscript"
+			}
+			t.Run(name, func(t *testing.T) {
+				deposit, _, err := BuildDepositContract(terms)
+				assert.NoError(t, err)
+				parsed, err := ParseDepositContract(deposit)
+				assert.NoError(t, err)
+				assert.True(t, parsed.AlicePubKey.IsEqual(terms.AlicePubKey))
+				assert.True(t, parsed.BobPubKey.IsEqual(terms.BobPubKey))
+				assert.Equal(t, terms.HashA, parsed.HashA)
+				assert.Equal(t, terms.HashB, parsed.HashB)
+				assert.Equal(t, terms.T, parsed.Timelock)
+				assert.Equal(t, form, parsed.ScriptForm)
+				assert.Equal(t, miniscript, parsed.Miniscript)
+				assert.NoError(t, CheckDepositContract(deposit, terms))
+
+				collateral, _, err := BuildCollateralContract(terms)
+				assert.NoError(t, err)
+				parsed, err = ParseCollateralContract(collateral)
+				assert.NoError(t, err)
+				assert.Equal(t, terms.Ell, parsed.Timelock)
+				assert.NoError(t, CheckCollateralContract(collateral, terms))
+
+				// each template only matches its own contract
+				_, err = ParseCollateralContract(deposit)
+				assert.True(t, errors.Is(err, ErrNotHeHTLC))
+				_, err = ParseDepositContract(collateral)
+				assert.True(t, errors.Is(err, ErrNotHeHTLC))
+			})
+		}
+	}
+}
+
+func TestParseContractErrors(t *testing.T) {
+	params := GenTestParams()
+	deposit, _, err := BuildDepositContract(&params.Terms)
+	assert.NoError(t, err)
+
+	// the multisig deposit is OP_2 <pkA> <pkB> OP_2 OP_CHECKMULTISIGVERIFY
+	// OP_HASH160 <hA> OP_EQUAL OP_IF ...
+	equal := bytes.IndexByte(deposit[2*34+3:], txscript.OP_EQUAL) + 2*34 + 3
+	mutations := []struct {
+		name   string
+		script []byte
+		msg    string
+	}{
+		{"empty", nil, "empty script"},
+		{"wrong opcode", replaceByte(deposit, equal, txscript.OP_EQUALVERIFY),
+			"opcode 7: expected OP_EQUAL, got OP_EQUALVERIFY"},
+		{"truncated", deposit[:len(deposit)-1], "opcode 17: expected OP_ENDIF, got end of script"},
+		{"trailing opcode", append(append([]byte{}, deposit...), txscript.OP_NOP),
+			"opcode 18: expected end of script, got OP_NOP"},
+		{"bad key", replaceByte(deposit, 1, txscript.OP_DATA_32),
+			"opcode 1: expected a compressed public key"},
+		{"bad push", deposit[:10], "opcode 1: "},
+	}
+	for _, m := range mutations {
+		t.Run(m.name, func(t *testing.T) {
+			_, err := ParseDepositContract(m.script)
+			assert.True(t, errors.Is(err, ErrNotHeHTLC), "%v", err)
+			assert.Contains(t, err.Error(), m.msg)
+		})
+	}
+
+	t.Run("other terms", func(t *testing.T) {
+		terms := params.Terms
+		terms.T++
+		err := CheckDepositContract(deposit, &terms)
+		assert.True(t, errors.Is(err, ErrTermsMismatch))
+		var paramErr *ParamError
+		assert.True(t, errors.As(err, &paramErr))
+		assert.Equal(t, "T", paramErr.Field)
+
+		terms = params.Terms
+		terms.AlicePubKey, terms.BobPubKey = terms.BobPubKey, terms.AlicePubKey
+		err = CheckDepositContract(deposit, &terms)
+		assert.True(t, errors.As(err, &paramErr))
+		assert.Equal(t, "AlicePubKey", paramErr.Field)
+	})
+}
+
+func replaceByte(script []byte, i int, b byte) []byte {
+	mutated := append([]byte{}, script...)
+	mutated[i] = b
+	return mutated
+}
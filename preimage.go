@@ -0,0 +1,41 @@
+package hehtlc
+
+import (
+	"fmt"
+	"github.com/btcsuite/btcd/wire"
+)
+
+// RevealedPreimages are the preimages a spending transaction made public.
+type RevealedPreimages struct {
+	// PreA and PreB are nil when the transaction does not reveal them.
+	PreA []byte
+	PreB []byte
+}
+
+// ExtractPreimages returns the preimages of the hash locks of terms revealed
+// by the witnesses of tx: preA for Dep-A, preB for Dep-B and both for Col-M.
+// Every witness element of every input is checked against the hash locks, so
+// it works on any transaction spending the contracts, whatever its layout. A
+// transaction revealing neither preimage fails with ErrMissingSecret.
+func ExtractPreimages(tx *wire.MsgTx, terms *ContractTerms) (*RevealedPreimages, error) {
+	if err := terms.Validate(); err != nil {
+		return nil, err
+	}
+
+	revealed := &RevealedPreimages{}
+	for _, txIn := range tx.TxIn {
+		for _, element := range txIn.Witness {
+			switch {
+			case revealed.PreA == nil && terms.HashFunc.matches(element, terms.HashA):
+				revealed.PreA = element
+			case revealed.PreB == nil && terms.HashFunc.matches(element, terms.HashB):
+				revealed.PreB = element
+			}
+		}
+	}
+
+	if revealed.PreA == nil && revealed.PreB == nil {
+		return nil, fmt.Errorf("%w: transaction %v reveals no preimage", ErrMissingSecret, tx.TxHash())
+	}
+	return revealed, nil
+}
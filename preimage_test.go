@@ -0,0 +1,53 @@
+package hehtlc
+
+import (
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestExtractPreimages(t *testing.T) {
+	for _, taproot := range []bool{false, true} {
+		params := GenTestParams()
+		if taproot {
+			params = genTaprootTestParams(nil)
+		}
+
+		revealed := map[SpendPath]*RevealedPreimages{
+			PathDepositAlice:    {PreA: params.Alice.PreA},
+			PathDepositBob:      {PreB: params.Bob.PreB},
+			PathCollateralBob:   nil,
+			PathCollateralMiner: {PreA: params.Alice.PreA, PreB: params.Bob.PreB},
+		}
+		for _, path := range setupPaths {
+			signed, err := signLocally(&params, path)
+			assert.NoError(t, err)
+
+			preimages, err := ExtractPreimages(signed.Tx, &params.Terms)
+			if revealed[path] == nil {
+				assert.True(t, errors.Is(err, ErrMissingSecret), path.String())
+				continue
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, revealed[path], preimages, path.String())
+		}
+	}
+
+	t.Run("cooperative", func(t *testing.T) {
+		params := genTaprootTestParams(nil)
+		signed, err := SpendHeHTLCCooperative(&params)
+		assert.NoError(t, err)
+		_, err = ExtractPreimages(signed.Tx, &params.Terms)
+		assert.True(t, errors.Is(err, ErrMissingSecret))
+	})
+
+	t.Run("other terms", func(t *testing.T) {
+		params := GenTestParams()
+		signed, err := signLocally(&params, PathCollateralMiner)
+		assert.NoError(t, err)
+		terms := params.Terms
+		terms.HashA, terms.HashB = make([]byte, 20), make([]byte, 20)
+		_, err = ExtractPreimages(signed.Tx, &terms)
+		assert.True(t, errors.Is(err, ErrMissingSecret))
+	})
+}
@@ -0,0 +1,293 @@
+package hehtlc
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"github.com/btcsuite/btcd/btcec/v2/schnorr"
+	"github.com/btcsuite/btcd/btcutil/psbt"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+)
+
+// PSBTProprietaryPrefix identifies the proprietary input fields (BIP-174 type
+// 0xFC) this package uses to carry the spend path and the preimages, so a
+// generic signer can pass them through untouched.
+const PSBTProprietaryPrefix = "hehtlc"
+
+// Subtypes of the proprietary input fields.
+const (
+	PSBTSubtypeSpendPath = 0x00
+	PSBTSubtypePreA      = 0x01
+	PSBTSubtypePreB      = 0x02
+)
+
+// SpendPSBT builds the unsigned transaction of path and exports it as a PSBT.
+// The preimages held in params that the witness of path reveals, if any, are
+// attached as proprietary fields; the others stay secret.
+func SpendPSBT(params *Parameters, path SpendPath) (*psbt.Packet, error) {
+	spend, err := NewUnsignedSpend(params, path)
+	if err != nil {
+		return nil, err
+	}
+
+	var preA, preB []byte
+	revealsA, revealsB := path.reveals()
+	if revealsA && params.Alice != nil {
+		preA = params.Alice.PreA
+	}
+	if revealsB && params.Bob != nil {
+		preB = params.Bob.PreB
+	}
+
+	return spend.ToPSBT(preA, preB)
+}
+
+// ToPSBT exports the spend as a PSBT carrying the witness script (or, for a
+// taproot contract, the BIP-371 leaf fields), the witness UTXO, the sighash
+// type and any signature already collected. preA and preB are attached as
+// proprietary fields when given.
+func (s *UnsignedSpend) ToPSBT(preA, preB []byte) (*psbt.Packet, error) {
+	packet, err := psbt.NewFromUnsignedTx(s.Tx.Copy())
+	if err != nil {
+		return nil, err
+	}
+
+	input := &packet.Inputs[0]
+	input.WitnessUtxo = wire.NewTxOut(s.Amount, s.PkScript)
+
+	if s.taproot() {
+		if err := s.addTaprootFields(input); err != nil {
+			return nil, err
+		}
+	} else {
+		input.WitnessScript = s.WitnessScript
+		input.SighashType = s.sigHashType()
+
+		pkA, pkB := s.terms.GetAliceBobPks()
+		if s.sigA != nil {
+			input.PartialSigs = append(input.PartialSigs, &psbt.PartialSig{PubKey: pkA, Signature: s.sigA})
+		}
+		if s.sigB != nil {
+			input.PartialSigs = append(input.PartialSigs, &psbt.PartialSig{PubKey: pkB, Signature: s.sigB})
+		}
+	}
+
+	input.Unknowns = append(input.Unknowns, &psbt.Unknown{
+		Key:   proprietaryKey(PSBTSubtypeSpendPath),
+		Value: []byte{byte(s.Path)},
+	})
+	if preA != nil {
+		input.Unknowns = append(input.Unknowns, &psbt.Unknown{
+			Key:   proprietaryKey(PSBTSubtypePreA),
+			Value: preA,
+		})
+	}
+	if preB != nil {
+		input.Unknowns = append(input.Unknowns, &psbt.Unknown{
+			Key:   proprietaryKey(PSBTSubtypePreB),
+			Value: preB,
+		})
+	}
+
+	return packet, nil
+}
+
+// FinalizePSBT turns a PSBT produced by ToPSBT, once signed by Alice and Bob,
+// back into the witness layout of its spend path and returns the signed
+// spend. Partial signatures are verified against terms, and the witness
+// script or leaf must be the one terms produce for that path.
+func FinalizePSBT(packet *psbt.Packet, terms *ContractTerms) (*SignedSpend, error) {
+	if len(packet.Inputs) == 0 {
+		return nil, fmt.Errorf("%w: PSBT has no inputs", ErrInvalidPSBT)
+	}
+	input := &packet.Inputs[0]
+
+	pathField := proprietaryValue(input, PSBTSubtypeSpendPath)
+	if len(pathField) != 1 {
+		return nil, fmt.Errorf("%w: missing spend path", ErrInvalidPSBT)
+	}
+	path := SpendPath(pathField[0])
+
+	witnessScript, controlBlock, pkScript, err := spendScripts(terms, path)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidPSBT, err)
+	}
+	if input.WitnessUtxo == nil || !bytes.Equal(input.WitnessUtxo.PkScript, pkScript) {
+		return nil, fmt.Errorf("%w: witness UTXO does not pay to the %v contract", ErrInvalidPSBT, path)
+	}
+
+	spend := &UnsignedSpend{
+		Path:          path,
+		Tx:            packet.UnsignedTx,
+		WitnessScript: witnessScript,
+		ControlBlock:  controlBlock,
+		PkScript:      pkScript,
+		Amount:        input.WitnessUtxo.Value,
+		terms:         terms,
+	}
+
+	if spend.taproot() {
+		err = spend.addTaprootSignatures(input)
+	} else {
+		err = spend.addPartialSignatures(input)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	signed, err := spend.Finalize(proprietaryValue(input, PSBTSubtypePreA), proprietaryValue(input, PSBTSubtypePreB))
+	if err != nil {
+		return nil, err
+	}
+
+	var witness bytes.Buffer
+	if err := psbt.WriteTxWitness(&witness, signed.Tx.TxIn[0].Witness); err != nil {
+		return nil, err
+	}
+
+	// BIP-174 finalizer: keep only the UTXO and the final witness
+	*input = psbt.PInput{
+		WitnessUtxo:        input.WitnessUtxo,
+		FinalScriptWitness: witness.Bytes(),
+		Unknowns:           input.Unknowns,
+	}
+
+	tx, err := psbt.Extract(packet)
+	if err != nil {
+		return nil, err
+	}
+
+	return newSignedSpend(path, tx, spend.Amount)
+}
+
+// addPartialSignatures checks the witness script of a P2WSH input and adds
+// its partial signatures to s.
+func (s *UnsignedSpend) addPartialSignatures(input *psbt.PInput) error {
+	if !bytes.Equal(input.WitnessScript, s.WitnessScript) {
+		return fmt.Errorf("%w: witness script does not match the %v contract", ErrInvalidPSBT, s.Path)
+	}
+
+	pkA, pkB := s.terms.GetAliceBobPks()
+	for _, partialSig := range input.PartialSigs {
+		var role Role
+		switch {
+		case bytes.Equal(partialSig.PubKey, pkA):
+			role = RoleAlice
+		case bytes.Equal(partialSig.PubKey, pkB):
+			role = RoleBob
+		default:
+			return fmt.Errorf("%w: signature by unknown key %x", ErrInvalidPSBT, partialSig.PubKey)
+		}
+		if err := s.AddSignature(role, partialSig.Signature); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addTaprootFields fills the BIP-371 fields of a tapscript input: internal
+// key, merkle root, the leaf of the spend path and any signature collected.
+func (s *UnsignedSpend) addTaprootFields(input *psbt.PInput) error {
+	controlBlock, err := txscript.ParseControlBlock(s.ControlBlock)
+	if err != nil {
+		return err
+	}
+	leaf := txscript.NewBaseTapLeaf(s.WitnessScript)
+	leafHash := leaf.TapHash()
+	rootHash := controlBlock.RootHash(s.WitnessScript)
+
+	input.SighashType = s.sigHashType()
+	input.TaprootInternalKey = schnorr.SerializePubKey(controlBlock.InternalKey)
+	input.TaprootMerkleRoot = rootHash
+	input.TaprootLeafScript = []*psbt.TaprootTapLeafScript{{
+		ControlBlock: s.ControlBlock,
+		Script:       s.WitnessScript,
+		LeafVersion:  leaf.LeafVersion,
+	}}
+
+	sigs := []struct {
+		pubKey []byte
+		sig    []byte
+	}{
+		{schnorr.SerializePubKey(s.terms.AlicePubKey), s.sigA},
+		{schnorr.SerializePubKey(s.terms.BobPubKey), s.sigB},
+	}
+	for _, sig := range sigs {
+		if sig.sig == nil {
+			continue
+		}
+		// BIP-371 keeps the sighash type out of the signature
+		input.TaprootScriptSpendSig = append(input.TaprootScriptSpendSig, &psbt.TaprootScriptSpendSig{
+			XOnlyPubKey: sig.pubKey,
+			LeafHash:    leafHash[:],
+			Signature:   sig.sig[:schnorr.SignatureSize],
+			SigHash:     s.sigHashType(),
+		})
+	}
+	return nil
+}
+
+// addTaprootSignatures checks the leaf of a tapscript input and adds its
+// script-path signatures to s.
+func (s *UnsignedSpend) addTaprootSignatures(input *psbt.PInput) error {
+	if len(input.TaprootLeafScript) != 1 ||
+		!bytes.Equal(input.TaprootLeafScript[0].Script, s.WitnessScript) ||
+		!bytes.Equal(input.TaprootLeafScript[0].ControlBlock, s.ControlBlock) {
+
+		return fmt.Errorf("%w: leaf script does not match the %v contract", ErrInvalidPSBT, s.Path)
+	}
+
+	leafHash := txscript.NewBaseTapLeaf(s.WitnessScript).TapHash()
+	pkA := schnorr.SerializePubKey(s.terms.AlicePubKey)
+	pkB := schnorr.SerializePubKey(s.terms.BobPubKey)
+	for _, partialSig := range input.TaprootScriptSpendSig {
+		if !bytes.Equal(partialSig.LeafHash, leafHash[:]) {
+			return fmt.Errorf("%w: signature over another leaf", ErrInvalidPSBT)
+		}
+		var role Role
+		switch {
+		case bytes.Equal(partialSig.XOnlyPubKey, pkA):
+			role = RoleAlice
+		case bytes.Equal(partialSig.XOnlyPubKey, pkB):
+			role = RoleBob
+		default:
+			return fmt.Errorf("%w: signature by unknown key %x", ErrInvalidPSBT, partialSig.XOnlyPubKey)
+		}
+		sig := partialSig.Signature
+		if partialSig.SigHash != txscript.SigHashDefault {
+			sig = append(sig[:len(sig):len(sig)], byte(partialSig.SigHash))
+		}
+		if err := s.AddSignature(role, sig); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// proprietaryKey returns the key of a proprietary field: 0xFC, the
+// length-prefixed identifier, the subtype and no key data.
+func proprietaryKey(subtype byte) []byte {
+	key := []byte{0xFC, byte(len(PSBTProprietaryPrefix))}
+	key = append(key, PSBTProprietaryPrefix...)
+	return append(key, subtype)
+}
+
+func proprietaryValue(input *psbt.PInput, subtype byte) []byte {
+	key := proprietaryKey(subtype)
+	for _, unknown := range input.Unknowns {
+		if bytes.Equal(unknown.Key, key) {
+			return unknown.Value
+		}
+	}
+	return nil
+}
+
+// p2wshScript returns the output script paying to witnessScript.
+func p2wshScript(witnessScript []byte) ([]byte, error) {
+	witnessScriptHash := sha256.Sum256(witnessScript)
+	return txscript.NewScriptBuilder().
+		AddOp(txscript.OP_0).
+		AddData(witnessScriptHash[:]).
+		Script()
+}
@@ -0,0 +1,90 @@
+package hehtlc
+
+import (
+	"bytes"
+	"errors"
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/btcutil/psbt"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestPSBTRoundTrip(t *testing.T) {
+	params := GenTestParams()
+
+	expected := map[SpendPath]string{
+		PathDepositAlice:    params.expectedTxDepAlice,
+		PathDepositBob:      params.expectedTxDepBob,
+		PathCollateralBob:   params.expectedTxColBob,
+		PathCollateralMiner: params.expectedTxColMiner,
+	}
+
+	for path, expectedTx := range expected {
+		t.Run(path.String(), func(t *testing.T) {
+			packet, err := SpendPSBT(&params, path)
+			assert.NoError(t, err)
+
+			// an external signer only sees a standard P2WSH input
+			encoded, err := packet.B64Encode()
+			assert.NoError(t, err)
+			packet, err = psbt.NewFromRawBytes(bytes.NewReader([]byte(encoded)), true)
+			assert.NoError(t, err)
+
+			updater, err := psbt.NewUpdater(packet)
+			assert.NoError(t, err)
+
+			spend, err := NewUnsignedSpend(&params, path)
+			assert.NoError(t, err)
+			pkA, pkB := params.Terms.GetAliceBobPks()
+			for _, signer := range []struct {
+				pk  []byte
+				key *btcutil.WIF
+			}{{pkA, params.Alice.PrivateKey}, {pkB, params.Bob.PrivateKey}} {
+				sig, err := spend.Sign(signer.key)
+				assert.NoError(t, err)
+				outcome, err := updater.Sign(0, sig, signer.pk, nil, nil)
+				assert.NoError(t, err)
+				assert.Equal(t, psbt.SignOutcome(psbt.SignSuccesful), outcome)
+			}
+
+			tx, err := FinalizePSBT(packet, &params.Terms)
+			assert.NoError(t, err)
+			assert.True(t, packet.IsComplete())
+
+			assert.Equal(t, expectedTx, tx.Hex)
+		})
+	}
+
+	t.Run("preimages", func(t *testing.T) {
+		for path, want := range map[SpendPath][2]bool{
+			PathDepositAlice:    {true, false},
+			PathDepositBob:      {false, true},
+			PathCollateralBob:   {false, false},
+			PathCollateralMiner: {true, true},
+		} {
+			packet, err := SpendPSBT(&params, path)
+			assert.NoError(t, err)
+			input := &packet.Inputs[0]
+			assert.Equal(t, want[0], proprietaryValue(input, PSBTSubtypePreA) != nil, path.String())
+			assert.Equal(t, want[1], proprietaryValue(input, PSBTSubtypePreB) != nil, path.String())
+		}
+	})
+
+	t.Run("unsigned", func(t *testing.T) {
+		packet, err := SpendPSBT(&params, PathCollateralBob)
+		assert.NoError(t, err)
+
+		_, err = FinalizePSBT(packet, &params.Terms)
+		assert.True(t, errors.Is(err, ErrMissingSignature))
+	})
+
+	t.Run("other contract", func(t *testing.T) {
+		packet, err := SpendPSBT(&params, PathCollateralBob)
+		assert.NoError(t, err)
+
+		terms := params.Terms
+		terms.Ell++
+		_, err = FinalizePSBT(packet, &terms)
+		assert.True(t, errors.Is(err, ErrInvalidPSBT))
+	})
+}
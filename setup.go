@@ -0,0 +1,239 @@
+package hehtlc
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/wire"
+)
+
+// setupPaths is the presigned tree of a He-HTLC:
+//
+//	deposit    → Dep-A / Dep-B
+//	collateral → Col-B / Col-M
+//
+// The collateral is the output of Dep-B.
+var setupPaths = []SpendPath{
+	PathDepositAlice,
+	PathDepositBob,
+	PathCollateralBob,
+	PathCollateralMiner,
+}
+
+// Signatures maps each spend path to one party's signature over it.
+type Signatures map[SpendPath][]byte
+
+// Setup runs the ceremony that must complete before Alice funds the deposit:
+// both parties build the same unsigned tree, sign it, exchange signatures and
+// store the resulting Bundle.
+type Setup struct {
+	spends map[SpendPath]*UnsignedSpend
+}
+
+// NewSetup builds the unsigned transaction tree from the contract terms,
+// payout addresses and deposit outpoint in params. The collateral outpoint is
+// always derived from Dep-B, whatever params say.
+func NewSetup(params *Parameters) (*Setup, error) {
+	treeParams, err := setupParams(params)
+	if err != nil {
+		return nil, err
+	}
+
+	setup := &Setup{spends: make(map[SpendPath]*UnsignedSpend)}
+	for _, path := range setupPaths {
+		spend, err := NewUnsignedSpend(treeParams, path)
+		if err != nil {
+			return nil, err
+		}
+		setup.spends[path] = spend
+	}
+
+	return setup, nil
+}
+
+// Sign signs every transaction of the tree as role. The returned signatures
+// are sent to the counterparty.
+func (s *Setup) Sign(role Role, key *btcutil.WIF) (Signatures, error) {
+	sigs := make(Signatures)
+	for _, path := range setupPaths {
+		sig, err := s.spends[path].SignAs(role, key)
+		if err != nil {
+			return nil, fmt.Errorf("hehtlc: signing %v: %w", path, err)
+		}
+		sigs[path] = sig
+	}
+	return sigs, nil
+}
+
+// AddSignatures verifies the counterparty's signatures over every
+// transaction of the tree and keeps them.
+func (s *Setup) AddSignatures(role Role, sigs Signatures) error {
+	for _, path := range setupPaths {
+		sig, ok := sigs[path]
+		if !ok {
+			return fmt.Errorf("%w: %v has no signature from %v", ErrMissingSignature, path, role)
+		}
+		if err := s.spends[path].AddSignature(role, sig); err != nil {
+			return fmt.Errorf("hehtlc: %v: %w", path, err)
+		}
+	}
+	return nil
+}
+
+// Bundle returns the presigned tree once every transaction carries both
+// signatures.
+func (s *Setup) Bundle() (*Bundle, error) {
+	bundle := &Bundle{}
+	for _, path := range setupPaths {
+		spend := s.spends[path]
+		if spend.sigA == nil || spend.sigB == nil {
+			return nil, fmt.Errorf("%w: %v needs both signatures", ErrMissingSignature, path)
+		}
+
+		var tx bytes.Buffer
+		if err := spend.Tx.Serialize(&tx); err != nil {
+			return nil, err
+		}
+
+		bundle.Transactions = append(bundle.Transactions, PresignedTx{
+			Path:          path,
+			Tx:            tx.Bytes(),
+			WitnessScript: spend.WitnessScript,
+			ControlBlock:  spend.ControlBlock,
+			Amount:        spend.Amount,
+			SigA:          spend.sigA,
+			SigB:          spend.sigB,
+		})
+	}
+	return bundle, nil
+}
+
+// Bundle is the presigned transaction tree each party stores before the
+// deposit is funded. It serializes to JSON as is.
+type Bundle struct {
+	Transactions []PresignedTx `json:"transactions"`
+}
+
+// PresignedTx is one unsigned transaction of the tree with both signatures
+// over it. The witness is only assembled once the preimages its path reveals
+// are known. For taproot contracts WitnessScript is the leaf script and
+// ControlBlock proves its inclusion.
+type PresignedTx struct {
+	Path          SpendPath `json:"path"`
+	Tx            []byte    `json:"tx"`
+	WitnessScript []byte    `json:"witness_script"`
+	ControlBlock  []byte    `json:"control_block,omitempty"`
+	Amount        int64     `json:"amount"`
+	SigA          []byte    `json:"sig_a"`
+	SigB          []byte    `json:"sig_b"`
+}
+
+// Verify rebuilds the tree from params and checks that the bundle holds
+// exactly those transactions, each with valid signatures from Alice and Bob.
+// A party should only fund or rely on the contract once this passes.
+func (b *Bundle) Verify(params *Parameters) error {
+	setup, err := NewSetup(params)
+	if err != nil {
+		return err
+	}
+
+	if len(b.Transactions) != len(setupPaths) {
+		return fmt.Errorf("%w: bundle holds %d transactions, want %d",
+			ErrInvalidBundle, len(b.Transactions), len(setupPaths))
+	}
+
+	for _, path := range setupPaths {
+		presigned, err := b.find(path)
+		if err != nil {
+			return err
+		}
+
+		expected := setup.spends[path]
+		var tx bytes.Buffer
+		if err := expected.Tx.Serialize(&tx); err != nil {
+			return err
+		}
+		if !bytes.Equal(presigned.Tx, tx.Bytes()) ||
+			!bytes.Equal(presigned.WitnessScript, expected.WitnessScript) ||
+			!bytes.Equal(presigned.ControlBlock, expected.ControlBlock) ||
+			presigned.Amount != expected.Amount {
+
+			return fmt.Errorf("%w: %v does not match the contract", ErrInvalidBundle, path)
+		}
+
+		if err := expected.AddSignature(RoleAlice, presigned.SigA); err != nil {
+			return fmt.Errorf("hehtlc: %v: %w", path, err)
+		}
+		if err := expected.AddSignature(RoleBob, presigned.SigB); err != nil {
+			return fmt.Errorf("hehtlc: %v: %w", path, err)
+		}
+	}
+
+	return nil
+}
+
+// Finalize assembles the witness of path from the presigned signatures and
+// the preimages the path reveals, see UnsignedSpend.Finalize.
+func (b *Bundle) Finalize(terms *ContractTerms, path SpendPath, preA, preB []byte) (*SignedSpend, error) {
+	presigned, err := b.find(path)
+	if err != nil {
+		return nil, err
+	}
+
+	tx := wire.NewMsgTx(2)
+	if err := tx.Deserialize(bytes.NewReader(presigned.Tx)); err != nil {
+		return nil, fmt.Errorf("%w: %v: %v", ErrInvalidBundle, path, err)
+	}
+
+	witnessScript, controlBlock, pkScript, err := spendScripts(terms, path)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(presigned.WitnessScript, witnessScript) || !bytes.Equal(presigned.ControlBlock, controlBlock) {
+		return nil, fmt.Errorf("%w: %v does not match the contract", ErrInvalidBundle, path)
+	}
+
+	spend := &UnsignedSpend{
+		Path:          path,
+		Tx:            tx,
+		WitnessScript: witnessScript,
+		ControlBlock:  controlBlock,
+		PkScript:      pkScript,
+		Amount:        presigned.Amount,
+		terms:         terms,
+	}
+	if err := spend.AddSignature(RoleAlice, presigned.SigA); err != nil {
+		return nil, err
+	}
+	if err := spend.AddSignature(RoleBob, presigned.SigB); err != nil {
+		return nil, err
+	}
+
+	return spend.Finalize(preA, preB)
+}
+
+func (b *Bundle) find(path SpendPath) (*PresignedTx, error) {
+	for i := range b.Transactions {
+		if b.Transactions[i].Path == path {
+			return &b.Transactions[i], nil
+		}
+	}
+	return nil, fmt.Errorf("%w: no %v transaction", ErrInvalidBundle, path)
+}
+
+// setupParams returns a copy of params whose collateral outpoint is the
+// output of Dep-B.
+func setupParams(params *Parameters) (*Parameters, error) {
+	treeParams := *params
+	treeParams.collateralUTXOForBob = fundingUTXO{}
+	treeParams.collateralUTXOForMiner = fundingUTXO{}
+
+	if err := treeParams.Validate(); err != nil {
+		return nil, err
+	}
+	if err := treeParams.DeriveCollateralUTXO(); err != nil {
+		return nil, err
+	}
+
+	return &treeParams, nil
+}
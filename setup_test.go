@@ -0,0 +1,80 @@
+package hehtlc
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestSetupCeremony(t *testing.T) {
+	params, err := NewParameters(testOptions(t)...)
+	assert.NoError(t, err)
+
+	// Alice and Bob each build the tree with only their own secrets
+	aliceParams, bobParams := *params, *params
+	aliceParams.Bob = nil
+	bobParams.Alice = nil
+
+	aliceSetup, err := NewSetup(&aliceParams)
+	assert.NoError(t, err)
+	bobSetup, err := NewSetup(&bobParams)
+	assert.NoError(t, err)
+
+	aliceSigs, err := aliceSetup.Sign(RoleAlice, params.Alice.PrivateKey)
+	assert.NoError(t, err)
+	bobSigs, err := bobSetup.Sign(RoleBob, params.Bob.PrivateKey)
+	assert.NoError(t, err)
+
+	_, err = bobSetup.Bundle()
+	assert.True(t, errors.Is(err, ErrMissingSignature))
+
+	// a signature for the wrong path is rejected
+	swapped := Signatures{}
+	for path, sig := range aliceSigs {
+		swapped[path] = sig
+	}
+	swapped[PathCollateralBob], swapped[PathCollateralMiner] = aliceSigs[PathCollateralMiner], aliceSigs[PathCollateralBob]
+	assert.True(t, errors.Is(bobSetup.AddSignatures(RoleAlice, swapped), ErrInvalidSignature))
+
+	assert.NoError(t, bobSetup.AddSignatures(RoleAlice, aliceSigs))
+	assert.NoError(t, aliceSetup.AddSignatures(RoleBob, bobSigs))
+
+	bobBundle, err := bobSetup.Bundle()
+	assert.NoError(t, err)
+	aliceBundle, err := aliceSetup.Bundle()
+	assert.NoError(t, err)
+	assert.Equal(t, aliceBundle, bobBundle)
+
+	// the bundle survives storage and verifies against the agreed terms
+	encoded, err := json.Marshal(bobBundle)
+	assert.NoError(t, err)
+	var stored Bundle
+	assert.NoError(t, json.Unmarshal(encoded, &stored))
+	assert.NoError(t, stored.Verify(&bobParams))
+
+	// Col-B and Col-M spend the output of Dep-B
+	depB, err := stored.Finalize(&params.Terms, PathDepositBob, nil, params.Bob.PreB)
+	assert.NoError(t, err)
+	colB, err := stored.Finalize(&params.Terms, PathCollateralBob, nil, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, depB.TxID, colB.Tx.TxIn[0].PreviousOutPoint.Hash)
+	colM, err := stored.Finalize(&params.Terms, PathCollateralMiner, params.Alice.PreA, params.Bob.PreB)
+	assert.NoError(t, err)
+	assert.Equal(t, depB.TxID, colM.Tx.TxIn[0].PreviousOutPoint.Hash)
+
+	t.Run("tampered", func(t *testing.T) {
+		var tampered Bundle
+		assert.NoError(t, json.Unmarshal(encoded, &tampered))
+		tampered.Transactions[1].Amount++
+		assert.True(t, errors.Is(tampered.Verify(params), ErrInvalidBundle))
+
+		assert.NoError(t, json.Unmarshal(encoded, &tampered))
+		tampered.Transactions[2].SigA = tampered.Transactions[3].SigA
+		assert.True(t, errors.Is(tampered.Verify(params), ErrInvalidSignature))
+
+		other := *params
+		other.Terms.Ell++
+		assert.True(t, errors.Is(stored.Verify(&other), ErrInvalidBundle))
+	})
+}
@@ -0,0 +1,437 @@
+package hehtlc
+
+import (
+	"fmt"
+	"github.com/btcsuite/btcd/btcec/v2"
+	"github.com/btcsuite/btcd/btcec/v2/ecdsa"
+	"github.com/btcsuite/btcd/btcec/v2/schnorr"
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+)
+
+// SpendPath identifies one of the four ways the deposit and collateral
+// contracts are spent.
+type SpendPath int
+
+const (
+	// PathDepositAlice is Dep-A: Alice reveals preA and the deposit pays vdep
+	// to Alice and vcol to Bob.
+	PathDepositAlice SpendPath = iota
+
+	// PathDepositBob is Dep-B: after T Bob reveals preB and moves the deposit
+	// into the collateral contract.
+	PathDepositBob
+
+	// PathCollateralBob is Col-B: after ell Bob claims the collateral.
+	PathCollateralBob
+
+	// PathCollateralMiner is Col-M: with preA and preB both public, vdep is
+	// burnt and vcol is left to the miner.
+	PathCollateralMiner
+
+	// PathCooperative is the key-path spend of a taproot deposit: it pays
+	// like Dep-A but reveals neither preA nor the scripts.
+	PathCooperative
+)
+
+func (path SpendPath) String() string {
+	switch path {
+	case PathDepositAlice:
+		return "Dep-A"
+	case PathDepositBob:
+		return "Dep-B"
+	case PathCollateralBob:
+		return "Col-B"
+	case PathCollateralMiner:
+		return "Col-M"
+	case PathCooperative:
+		return "Coop"
+	default:
+		return fmt.Sprintf("SpendPath(%d)", int(path))
+	}
+}
+
+// reveals reports which preimages the witness of path puts on chain.
+func (path SpendPath) reveals() (preA, preB bool) {
+	preA = path == PathDepositAlice || path == PathCollateralMiner
+	preB = path == PathDepositBob || path == PathCollateralMiner
+	return preA, preB
+}
+
+// Role is one of the two parties whose signatures every spend path needs.
+type Role int
+
+const (
+	RoleAlice Role = iota
+	RoleBob
+)
+
+func (role Role) String() string {
+	switch role {
+	case RoleAlice:
+		return "Alice"
+	case RoleBob:
+		return "Bob"
+	default:
+		return fmt.Sprintf("Role(%d)", int(role))
+	}
+}
+
+func (role Role) counterparty() Role {
+	if role == RoleAlice {
+		return RoleBob
+	}
+	return RoleAlice
+}
+
+// UnsignedSpend is the transaction of one spend path before its witness is
+// assembled. Each party signs it on its own machine with SignAs, sends the
+// signature over, and the receiver checks it with AddSignature. Once both
+// signatures are present Finalize builds the witness stack.
+type UnsignedSpend struct {
+	Path SpendPath
+	Tx   *wire.MsgTx
+
+	// WitnessScript is the P2WSH witness script, or the tapscript leaf, of
+	// the contract output being spent. ControlBlock is only set for taproot
+	// contracts and proves the leaf is committed to by the output key.
+	WitnessScript []byte
+	ControlBlock  []byte
+
+	// PkScript and Amount describe the output being spent. BIP-143 signatures
+	// commit to the amount, BIP-341 ones to both.
+	PkScript []byte
+	Amount   int64
+
+	terms *ContractTerms
+	sigA  []byte
+	sigB  []byte
+}
+
+// NewUnsignedSpend builds the unsigned transaction for path. Only the public
+// terms, payout addresses and funding outpoints of params are used, so it
+// works on either side of the swap. params must pass Validate.
+func NewUnsignedSpend(params *Parameters, path SpendPath) (*UnsignedSpend, error) {
+	if err := params.Validate(); err != nil {
+		return nil, err
+	}
+
+	var (
+		tx     *wire.MsgTx
+		amount int64
+		err    error
+	)
+	switch path {
+	case PathDepositAlice:
+		tx, amount, err = unsignedDepositAlice(params, PathDepositAlice)
+	case PathDepositBob:
+		tx, amount, err = unsignedDepositBob(params)
+	case PathCollateralBob:
+		tx, amount, err = unsignedCollateralBob(params)
+	case PathCollateralMiner:
+		tx, amount, err = unsignedCollateralMiner(params)
+	default:
+		return nil, fmt.Errorf("hehtlc: unknown spend path %v", path)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if hashType := params.Terms.sigHashType(path); hashType&sigHashMask == txscript.SigHashSingle && len(tx.TxOut) != 1 {
+		return nil, paramErrorf("SigHashes", ErrInvalidSigHash,
+			"%v has %d outputs, %v would only sign the first", path, len(tx.TxOut), hashType)
+	}
+
+	witnessScript, controlBlock, pkScript, err := spendScripts(&params.Terms, path)
+	if err != nil {
+		return nil, err
+	}
+
+	return &UnsignedSpend{
+		Path:          path,
+		Tx:            tx,
+		WitnessScript: witnessScript,
+		ControlBlock:  controlBlock,
+		PkScript:      pkScript,
+		Amount:        amount,
+		terms:         &params.Terms,
+	}, nil
+}
+
+// SigHash returns the digest both parties sign: BIP-143 for P2WSH
+// contracts, BIP-342 for tapscript leaves, under the sighash type the terms
+// set for the path.
+func (s *UnsignedSpend) SigHash() ([]byte, error) {
+	// BIP-143 signs the amount of UTXO too
+	prevOutput := txscript.NewCannedPrevOutputFetcher(s.PkScript, s.Amount)
+	sigHashes := txscript.NewTxSigHashes(s.Tx, prevOutput)
+
+	if s.taproot() {
+		return txscript.CalcTapscriptSignaturehash(sigHashes, s.sigHashType(), s.Tx, 0,
+			prevOutput, txscript.NewBaseTapLeaf(s.WitnessScript))
+	}
+	return txscript.CalcWitnessSigHash(s.WitnessScript, sigHashes, s.sigHashType(), s.Tx, 0, s.Amount)
+}
+
+// Sign returns the signature of key over the spend without storing it:
+// ECDSA for P2WSH contracts, Schnorr for tapscript leaves, with the sighash
+// type the terms set for the path (SIGHASH_ALL and SIGHASH_DEFAULT unless
+// told otherwise).
+func (s *UnsignedSpend) Sign(key *btcutil.WIF) ([]byte, error) {
+	prevOutput := txscript.NewCannedPrevOutputFetcher(s.PkScript, s.Amount)
+	sigHashes := txscript.NewTxSigHashes(s.Tx, prevOutput)
+
+	if s.taproot() {
+		return txscript.RawTxInTapscriptSignature(s.Tx, sigHashes, 0, s.Amount, s.PkScript,
+			txscript.NewBaseTapLeaf(s.WitnessScript), s.sigHashType(), key.PrivKey)
+	}
+	return txscript.RawTxInWitnessSignature(s.Tx, sigHashes, 0, s.Amount, s.WitnessScript, s.sigHashType(), key.PrivKey)
+}
+
+// SignAs signs the spend as role and keeps the signature for Finalize. The
+// signature is returned so it can be sent to the counterparty.
+func (s *UnsignedSpend) SignAs(role Role, key *btcutil.WIF) ([]byte, error) {
+	if key == nil {
+		return nil, &ParamError{Field: "PrivateKey", Err: ErrMissingValue}
+	}
+	pubKey, err := s.terms.pubKey(role)
+	if err != nil {
+		return nil, err
+	}
+	if !key.PrivKey.PubKey().IsEqual(pubKey) {
+		return nil, fmt.Errorf("%w: key is not %v's contract key", ErrSecretMismatch, role)
+	}
+
+	sig, err := s.Sign(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return sig, s.setSignature(role, sig)
+}
+
+// VerifySignature checks that sig is a valid signature by role over this
+// spend, with the sighash type Sign uses.
+func (s *UnsignedSpend) VerifySignature(role Role, sig []byte) error {
+	pubKey, err := s.terms.pubKey(role)
+	if err != nil {
+		return err
+	}
+
+	if s.taproot() {
+		return s.verifySchnorr(role, pubKey, sig)
+	}
+
+	if len(sig) < 2 {
+		return fmt.Errorf("%w: %v's signature is too short", ErrInvalidSignature, role)
+	}
+	hashType := txscript.SigHashType(sig[len(sig)-1])
+	if hashType != s.sigHashType() {
+		return fmt.Errorf("%w: %v signed with sighash type %v", ErrInvalidSignature, role, hashType)
+	}
+
+	signature, err := ecdsa.ParseDERSignature(sig[:len(sig)-1])
+	if err != nil {
+		return fmt.Errorf("%w: %v: %v", ErrInvalidSignature, role, err)
+	}
+
+	sigHash, err := s.SigHash()
+	if err != nil {
+		return err
+	}
+	if !signature.Verify(sigHash, pubKey) {
+		return fmt.Errorf("%w: %v's signature does not verify", ErrInvalidSignature, role)
+	}
+
+	return nil
+}
+
+func (s *UnsignedSpend) verifySchnorr(role Role, pubKey *btcec.PublicKey, sig []byte) error {
+	// SIGHASH_DEFAULT signatures carry no sighash byte
+	size := schnorr.SignatureSize
+	if s.sigHashType() != txscript.SigHashDefault {
+		size++
+	}
+	if len(sig) != size {
+		return fmt.Errorf("%w: %v's signature is %d bytes, want %d",
+			ErrInvalidSignature, role, len(sig), size)
+	}
+	if size > schnorr.SignatureSize {
+		if hashType := txscript.SigHashType(sig[size-1]); hashType != s.sigHashType() {
+			return fmt.Errorf("%w: %v signed with sighash type %v", ErrInvalidSignature, role, hashType)
+		}
+		sig = sig[:schnorr.SignatureSize]
+	}
+
+	signature, err := schnorr.ParseSignature(sig)
+	if err != nil {
+		return fmt.Errorf("%w: %v: %v", ErrInvalidSignature, role, err)
+	}
+
+	sigHash, err := s.SigHash()
+	if err != nil {
+		return err
+	}
+	if !signature.Verify(sigHash, pubKey) {
+		return fmt.Errorf("%w: %v's signature does not verify", ErrInvalidSignature, role)
+	}
+
+	return nil
+}
+
+// AddSignature verifies the counterparty's signature and keeps it for
+// Finalize.
+func (s *UnsignedSpend) AddSignature(role Role, sig []byte) error {
+	if err := s.VerifySignature(role, sig); err != nil {
+		return err
+	}
+	return s.setSignature(role, sig)
+}
+
+// Finalize assembles the witness stack once both signatures are present,
+// checks the result with VerifySpend and returns the signed spend. Dep-A
+// needs preA, Dep-B needs preB, Col-M needs both and Col-B neither;
+// preimages a path does not use are ignored.
+func (s *UnsignedSpend) Finalize(preA, preB []byte) (*SignedSpend, error) {
+	if s.sigA == nil || s.sigB == nil {
+		return nil, fmt.Errorf("%w: %v needs both signatures", ErrMissingSignature, s.Path)
+	}
+
+	needA, needB := s.Path.reveals()
+	if needA {
+		if err := checkPreimage("preA", preA, s.terms, s.terms.HashA); err != nil {
+			return nil, err
+		}
+	}
+	if needB {
+		if err := checkPreimage("preB", preB, s.terms, s.terms.HashB); err != nil {
+			return nil, err
+		}
+	}
+
+	//!!! everything below is NOT covered by signatures.
+	// See https://wiki.bitcoinsv.io/index.php/SIGHASH_flags
+
+	var witness wire.TxWitness
+	if s.taproot() {
+		witness = s.tapscriptWitness(preA, preB)
+	} else {
+		witness = s.witness(preA, preB)
+	}
+
+	tx := s.Tx.Copy()
+	tx.TxIn[0].Witness = witness
+
+	// never hand out a transaction that would fail consensus
+	if err := VerifySpend(tx, txscript.NewCannedPrevOutputFetcher(s.PkScript, s.Amount)); err != nil {
+		return nil, fmt.Errorf("hehtlc: %v: %w", s.Path, err)
+	}
+
+	return newSignedSpend(s.Path, tx, s.Amount)
+}
+
+// witness returns the witness stack spending the P2WSH contract.
+func (s *UnsignedSpend) witness(preA, preB []byte) wire.TxWitness {
+	dummy := []byte{0x00}
+	if size := s.terms.preimageSize(); size > 0 {
+		// a size-checked hash lock is dissatisfied by any other preimage of
+		// that size
+		dummy = make([]byte, size)
+	}
+
+	var inputs wire.TxWitness
+	switch s.Path {
+	case PathDepositAlice:
+		inputs = wire.TxWitness{preA}
+	case PathDepositBob:
+		inputs = wire.TxWitness{
+			preB,
+			dummy, // add dummy value to be consumed by the first hash lock
+		}
+	case PathCollateralBob:
+		inputs = wire.TxWitness{
+			dummy, // add dummy value to be consumed by the first hash lock
+		}
+	case PathCollateralMiner:
+		inputs = wire.TxWitness{preB, preA}
+	}
+
+	// the miniscript encoding selects its branch with OP_IF instead of a
+	// dummy preimage: the first one for Dep-A and Col-B, the second for
+	// Dep-B and Col-M
+	var branch wire.TxWitness
+	if s.terms.Miniscript {
+		switch s.Path {
+		case PathDepositAlice:
+			branch = wire.TxWitness{{0x01}}
+		case PathDepositBob:
+			inputs, branch = wire.TxWitness{preB}, wire.TxWitness{{}}
+		case PathCollateralBob:
+			inputs, branch = nil, wire.TxWitness{{0x01}}
+		case PathCollateralMiner:
+			branch = wire.TxWitness{{}}
+		}
+	}
+
+	if s.terms.signatureForm() == ScriptFormMultisig {
+		inputs = append(inputs,
+			[]byte{}, // dummy value for MULTISIG must be empty per https://github.com/bitcoin/bips/blob/master/bip-0147.mediawiki
+			s.sigA,
+			s.sigB,
+		)
+	} else {
+		// the script checks sigA first, so it must be on top of the stack
+		inputs = append(inputs, s.sigB, s.sigA)
+	}
+	return append(append(inputs, branch...), s.WitnessScript)
+}
+
+// tapscriptWitness returns the witness stack spending the leaf of path:
+// its inputs, both signatures, the leaf script and its control block.
+func (s *UnsignedSpend) tapscriptWitness(preA, preB []byte) wire.TxWitness {
+	var inputs wire.TxWitness
+	switch s.Path {
+	case PathDepositAlice:
+		inputs = wire.TxWitness{preA}
+	case PathDepositBob:
+		inputs = wire.TxWitness{preB}
+	case PathCollateralMiner:
+		inputs = wire.TxWitness{preB, preA}
+	}
+
+	// the leaf checks sigA first, so it must be on top of the stack
+	return append(inputs, s.sigB, s.sigA, s.WitnessScript, s.ControlBlock)
+}
+
+func (s *UnsignedSpend) taproot() bool {
+	return s.ControlBlock != nil
+}
+
+func (s *UnsignedSpend) sigHashType() txscript.SigHashType {
+	return s.terms.sigHashType(s.Path)
+}
+
+func (s *UnsignedSpend) setSignature(role Role, sig []byte) error {
+	switch role {
+	case RoleAlice:
+		s.sigA = sig
+	case RoleBob:
+		s.sigB = sig
+	default:
+		return fmt.Errorf("hehtlc: unknown role %v", role)
+	}
+	return nil
+}
+
+func checkPreimage(name string, preimage []byte, terms *ContractTerms, hashLock []byte) error {
+	if len(preimage) == 0 {
+		return fmt.Errorf("%w: %s", ErrMissingSecret, name)
+	}
+	if size := terms.preimageSize(); size > 0 && len(preimage) != size {
+		return fmt.Errorf("%w: %s is %d bytes, the hash lock checks %d", ErrSecretMismatch, name, len(preimage), size)
+	}
+	if !terms.HashFunc.matches(preimage, hashLock) {
+		return fmt.Errorf("%w: %s does not match its hash lock", ErrSecretMismatch, name)
+	}
+	return nil
+}
@@ -0,0 +1,171 @@
+package hehtlc
+
+import (
+	"errors"
+	"fmt"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestTwoPartySigning(t *testing.T) {
+	params := GenTestParams()
+
+	// each party only holds its own secrets
+	aliceParams, bobParams := params, params
+	aliceParams.Bob = nil
+	bobParams.Alice = nil
+
+	expected := map[SpendPath]string{
+		PathDepositAlice:    params.expectedTxDepAlice,
+		PathDepositBob:      params.expectedTxDepBob,
+		PathCollateralBob:   params.expectedTxColBob,
+		PathCollateralMiner: params.expectedTxColMiner,
+	}
+
+	for path, expectedTx := range expected {
+		t.Run(path.String(), func(t *testing.T) {
+			aliceSpend, err := NewUnsignedSpend(&aliceParams, path)
+			assert.NoError(t, err)
+			bobSpend, err := NewUnsignedSpend(&bobParams, path)
+			assert.NoError(t, err)
+
+			sigA, err := aliceSpend.SignAs(RoleAlice, params.Alice.PrivateKey)
+			assert.NoError(t, err)
+			sigB, err := bobSpend.SignAs(RoleBob, params.Bob.PrivateKey)
+			assert.NoError(t, err)
+
+			// signatures are checked against the right key
+			assert.True(t, errors.Is(bobSpend.AddSignature(RoleAlice, sigB), ErrInvalidSignature))
+			_, err = bobSpend.Finalize(params.Alice.PreA, params.Bob.PreB)
+			assert.True(t, errors.Is(err, ErrMissingSignature))
+
+			assert.NoError(t, bobSpend.AddSignature(RoleAlice, sigA))
+			assert.NoError(t, aliceSpend.AddSignature(RoleBob, sigB))
+
+			tx, err := bobSpend.Finalize(params.Alice.PreA, params.Bob.PreB)
+			assert.NoError(t, err)
+
+			assert.Equal(t, expectedTx, tx.Hex)
+		})
+	}
+
+	t.Run("wrong key", func(t *testing.T) {
+		spend, err := NewUnsignedSpend(&params, PathCollateralBob)
+		assert.NoError(t, err)
+
+		_, err = spend.SignAs(RoleAlice, params.Bob.PrivateKey)
+		assert.True(t, errors.Is(err, ErrSecretMismatch))
+
+		_, err = spend.SignAs(RoleAlice, nil)
+		var paramErr *ParamError
+		assert.True(t, errors.As(err, &paramErr))
+		assert.Equal(t, "PrivateKey", paramErr.Field)
+		assert.True(t, errors.Is(err, ErrMissingValue))
+	})
+
+	t.Run("invalid parameters", func(t *testing.T) {
+		noNet := params
+		noNet.Terms.Net = nil
+		_, err := NewUnsignedSpend(&noNet, PathDepositAlice)
+		assert.True(t, errors.Is(err, ErrMissingValue))
+
+		noKey := params
+		noKey.Terms.BobPubKey = nil
+		WithAnchors(AnchorKeyed)(&noKey)
+		for _, path := range setupPaths {
+			_, err = NewUnsignedSpend(&noKey, path)
+			assert.True(t, errors.Is(err, ErrMissingValue), path.String())
+			_, err = signLocally(&noKey, path)
+			assert.True(t, errors.Is(err, ErrMissingValue), path.String())
+		}
+	})
+
+	t.Run("wrong preimage", func(t *testing.T) {
+		spend, err := NewUnsignedSpend(&params, PathDepositAlice)
+		assert.NoError(t, err)
+		_, err = spend.SignAs(RoleAlice, params.Alice.PrivateKey)
+		assert.NoError(t, err)
+		_, err = spend.SignAs(RoleBob, params.Bob.PrivateKey)
+		assert.NoError(t, err)
+
+		_, err = spend.Finalize(params.Bob.PreB, nil)
+		assert.True(t, errors.Is(err, ErrSecretMismatch))
+	})
+}
+
+func TestSigHashTypes(t *testing.T) {
+	singleACP := txscript.SigHashSingle | txscript.SigHashAnyOneCanPay
+	for _, taproot := range []bool{false, true} {
+		t.Run(fmt.Sprintf("taproot=%t", taproot), func(t *testing.T) {
+			params := GenTestParams()
+			if taproot {
+				params = genTaprootTestParams(nil)
+			}
+			WithSigHash(PathCollateralBob, singleACP)(&params)
+			WithSigHash(PathCollateralMiner, singleACP)(&params)
+			assert.NoError(t, params.Validate())
+
+			for _, path := range setupPaths {
+				spend, err := NewUnsignedSpend(&params, path)
+				assert.NoError(t, err)
+				sig, err := spend.SignAs(RoleAlice, params.Alice.PrivateKey)
+				assert.NoError(t, err)
+				if path == PathCollateralBob || path == PathCollateralMiner {
+					assert.Equal(t, byte(singleACP), sig[len(sig)-1], path.String())
+				}
+				_, err = spend.SignAs(RoleBob, params.Bob.PrivateKey)
+				assert.NoError(t, err)
+
+				// the sighash type survives a PSBT round trip
+				packet, err := spend.ToPSBT(params.Alice.PreA, params.Bob.PreB)
+				assert.NoError(t, err)
+				_, err = FinalizePSBT(packet, &params.Terms)
+				assert.NoError(t, err, path.String())
+			}
+
+			// a signature with another sighash type is rejected
+			defaults := params
+			defaults.Terms.SigHashes = nil
+			spend, err := NewUnsignedSpend(&defaults, PathCollateralBob)
+			assert.NoError(t, err)
+			sig, err := spend.Sign(params.Alice.PrivateKey)
+			assert.NoError(t, err)
+			spend, err = NewUnsignedSpend(&params, PathCollateralBob)
+			assert.NoError(t, err)
+			assert.True(t, errors.Is(spend.AddSignature(RoleAlice, sig), ErrInvalidSignature))
+		})
+	}
+
+	t.Run("multiple outputs", func(t *testing.T) {
+		params := GenTestParams()
+		WithSigHash(PathDepositAlice, singleACP)(&params)
+		_, err := NewUnsignedSpend(&params, PathDepositAlice)
+		assert.True(t, errors.Is(err, ErrInvalidSigHash))
+
+		params = GenTestParams()
+		WithSigHash(PathCollateralBob, singleACP)(&params)
+		WithAnchors(AnchorEphemeral)(&params)
+		assert.NoError(t, params.DeriveCollateralUTXO())
+		_, err = NewUnsignedSpend(&params, PathCollateralBob)
+		assert.True(t, errors.Is(err, ErrInvalidSigHash))
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		cases := []struct {
+			path     SpendPath
+			hashType txscript.SigHashType
+		}{
+			{PathDepositBob, txscript.SigHashNone},
+			{PathDepositBob, txscript.SigHashDefault},
+			{PathCooperative, txscript.SigHashAll},
+			// Col-B and Col-M are presigned against the txid of Dep-B
+			{PathDepositBob, singleACP},
+		}
+		for _, c := range cases {
+			params := GenTestParams()
+			WithSigHash(c.path, c.hashType)(&params)
+			assert.True(t, errors.Is(params.Validate(), ErrInvalidSigHash), c.path.String())
+		}
+	})
+}
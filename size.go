@@ -0,0 +1,94 @@
+package hehtlc
+
+import (
+	"github.com/btcsuite/btcd/btcec/v2/schnorr"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+)
+
+// Sizes assumed when a witness is estimated before it can be built: the
+// largest low-S DER signature with its sighash byte, a SIGHASH_DEFAULT
+// Schnorr signature and a 32-byte preimage when the terms fix no size.
+const (
+	maxECDSASignatureSize = 72
+	schnorrSignatureSize  = schnorr.SignatureSize
+	estimatedPreimageSize = 32
+)
+
+// WitnessSizes maps each spend path to the estimated size of its witness.
+type WitnessSizes map[SpendPath]int
+
+// EstimateWitnessSize returns the serialized size in bytes, which is also its
+// weight, of the witness spending path under terms. Signatures are counted at
+// their largest size, so the estimate is never short.
+func EstimateWitnessSize(terms *ContractTerms, path SpendPath) (int, error) {
+	if err := terms.Validate(); err != nil {
+		return 0, err
+	}
+
+	if path == PathCooperative {
+		if !terms.Taproot {
+			return 0, paramErrorf("Taproot", ErrMissingValue, "the cooperative close needs a taproot deposit")
+		}
+		// a key-path spend is the aggregate signature alone
+		return wire.TxWitness{make([]byte, schnorrSignatureSize)}.SerializeSize(), nil
+	}
+
+	witnessScript, controlBlock, _, err := spendScripts(terms, path)
+	if err != nil {
+		return 0, err
+	}
+
+	sigSize := maxECDSASignatureSize
+	if terms.Taproot {
+		sigSize = schnorrSignatureSize
+		if terms.sigHashType(path) != txscript.SigHashDefault {
+			// any other type is appended to the signature
+			sigSize++
+		}
+	}
+	spend := &UnsignedSpend{
+		Path:          path,
+		WitnessScript: witnessScript,
+		ControlBlock:  controlBlock,
+		terms:         terms,
+		sigA:          make([]byte, sigSize),
+		sigB:          make([]byte, sigSize),
+	}
+
+	preimageSize := estimatedPreimageSize
+	if size := terms.preimageSize(); size > 0 {
+		preimageSize = size
+	}
+	preimage := make([]byte, preimageSize)
+	if spend.taproot() {
+		return spend.tapscriptWitness(preimage, preimage).SerializeSize(), nil
+	}
+	return spend.witness(preimage, preimage).SerializeSize(), nil
+}
+
+// CompareScriptForms estimates the witness of every presigned path under each
+// script form the contract type allows, everything else in terms unchanged.
+func CompareScriptForms(terms *ContractTerms) (map[ScriptForm]WitnessSizes, error) {
+	forms := []ScriptForm{ScriptFormMultisig, ScriptFormCheckSig}
+	if terms.Taproot {
+		forms = []ScriptForm{ScriptFormCheckSig, ScriptFormCheckSigAdd}
+	}
+
+	comparison := make(map[ScriptForm]WitnessSizes)
+	for _, form := range forms {
+		formTerms := *terms
+		formTerms.ScriptForm = form
+
+		sizes := make(WitnessSizes)
+		for _, path := range setupPaths {
+			size, err := EstimateWitnessSize(&formTerms, path)
+			if err != nil {
+				return nil, err
+			}
+			sizes[path] = size
+		}
+		comparison[form] = sizes
+	}
+	return comparison, nil
+}
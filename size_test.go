@@ -0,0 +1,97 @@
+package hehtlc
+
+import (
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestScriptForms(t *testing.T) {
+	forms := []struct {
+		name    string
+		taproot bool
+		form    ScriptForm
+	}{
+		{"P2WSH multisig", false, ScriptFormMultisig},
+		{"P2WSH checksig", false, ScriptFormCheckSig},
+		{"taproot checksig", true, ScriptFormCheckSig},
+		{"taproot checksigadd", true, ScriptFormCheckSigAdd},
+	}
+
+	for _, f := range forms {
+		t.Run(f.name, func(t *testing.T) {
+			// Dep-B pays another collateral script, so derive its outpoint
+			params := GenTestParams()
+			params.Terms.Taproot = f.taproot
+			params.Terms.ScriptForm = f.form
+			params.collateralUTXOForBob = fundingUTXO{}
+			params.collateralUTXOForMiner = fundingUTXO{}
+
+			for _, path := range setupPaths {
+				signed, err := signLocally(&params, path)
+				assert.NoError(t, err, path.String())
+
+				// the estimate is an upper bound, short by at most the
+				// bytes of two ECDSA signatures shorter than the maximum
+				estimate, err := EstimateWitnessSize(&params.Terms, path)
+				assert.NoError(t, err)
+				actual := signed.Tx.TxIn[0].Witness.SerializeSize()
+				assert.GreaterOrEqual(t, estimate, actual, path.String())
+				assert.LessOrEqual(t, estimate-actual, 4, path.String())
+
+				if f.form == ScriptFormCheckSig && !f.taproot {
+					for _, item := range signed.Tx.TxIn[0].Witness {
+						assert.NotEmpty(t, item, "no NULLDUMMY without OP_CHECKMULTISIG")
+					}
+				}
+			}
+		})
+	}
+
+	t.Run("default is multisig", func(t *testing.T) {
+		params := GenTestParams()
+		multisig := params.Terms
+		multisig.ScriptForm = ScriptFormMultisig
+
+		defaultScript, _, err := BuildDepositContract(&params.Terms)
+		assert.NoError(t, err)
+		multisigScript, _, err := BuildDepositContract(&multisig)
+		assert.NoError(t, err)
+		assert.Equal(t, multisigScript, defaultScript)
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		params := GenTestParams()
+		terms := params.Terms
+		terms.ScriptForm = ScriptFormCheckSigAdd
+		assert.True(t, errors.Is(terms.Validate(), ErrInvalidScriptForm))
+
+		terms.Taproot = true
+		terms.ScriptForm = ScriptFormMultisig
+		assert.True(t, errors.Is(terms.Validate(), ErrInvalidScriptForm))
+	})
+}
+
+func TestCompareScriptForms(t *testing.T) {
+	params := GenTestParams()
+
+	comparison, err := CompareScriptForms(&params.Terms)
+	assert.NoError(t, err)
+	assert.Len(t, comparison, 2)
+	for _, path := range setupPaths {
+		// no NULLDUMMY and no OP_2 ... OP_2 around the keys
+		assert.Less(t, comparison[ScriptFormCheckSig][path], comparison[ScriptFormMultisig][path], path.String())
+	}
+
+	params.Terms.Taproot = true
+	comparison, err = CompareScriptForms(&params.Terms)
+	assert.NoError(t, err)
+	assert.Len(t, comparison, 2)
+	for _, path := range setupPaths {
+		// OP_CHECKSIGADD costs an OP_2 OP_NUMEQUALVERIFY
+		assert.Equal(t, comparison[ScriptFormCheckSig][path]+2, comparison[ScriptFormCheckSigAdd][path], path.String())
+	}
+
+	_, err = EstimateWitnessSize(&params.Terms, PathCooperative)
+	assert.NoError(t, err)
+}
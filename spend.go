@@ -0,0 +1,60 @@
+package hehtlc
+
+import (
+	"bytes"
+	"encoding/hex"
+	"github.com/btcsuite/btcd/blockchain"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+)
+
+// SignedSpend is a fully signed He-HTLC spend together with what monitoring
+// and broadcast code needs to know about it.
+type SignedSpend struct {
+	// Path is the contract path the transaction spends.
+	Path SpendPath
+
+	Tx *wire.MsgTx
+	// Hex is the serialized transaction, ready to broadcast.
+	Hex string
+
+	TxID  chainhash.Hash
+	WTxID chainhash.Hash
+
+	Weight int64
+	VSize  int64
+
+	// Fee is the absolute fee in satoshis and FeeRate the fee per vbyte.
+	Fee     int64
+	FeeRate float64
+}
+
+// newSignedSpend describes tx, a spend of path whose inputs are worth
+// inputAmount.
+func newSignedSpend(path SpendPath, tx *wire.MsgTx, inputAmount int64) (*SignedSpend, error) {
+	var buf bytes.Buffer
+	if err := tx.Serialize(&buf); err != nil {
+		return nil, err
+	}
+
+	var outputAmount int64
+	for _, txOut := range tx.TxOut {
+		outputAmount += txOut.Value
+	}
+
+	weight := int64(tx.SerializeSizeStripped()*(blockchain.WitnessScaleFactor-1) + tx.SerializeSize())
+	vsize := (weight + blockchain.WitnessScaleFactor - 1) / blockchain.WitnessScaleFactor
+	fee := inputAmount - outputAmount
+
+	return &SignedSpend{
+		Path:    path,
+		Tx:      tx,
+		Hex:     hex.EncodeToString(buf.Bytes()),
+		TxID:    tx.TxHash(),
+		WTxID:   tx.WitnessHash(),
+		Weight:  weight,
+		VSize:   vsize,
+		Fee:     fee,
+		FeeRate: float64(fee) / float64(vsize),
+	}, nil
+}
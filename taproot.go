@@ -0,0 +1,204 @@
+package hehtlc
+
+import (
+	"encoding/hex"
+	"fmt"
+	"github.com/btcsuite/btcd/btcec/v2"
+	"github.com/btcsuite/btcd/btcec/v2/schnorr"
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+)
+
+// NUMSInternalKey is the BIP-341 point H = lift_x(sha256(G)): nobody knows its
+// discrete log, so a contract using it as internal key can only be spent
+// through its script leaves.
+var NUMSInternalKey = mustParseXOnly("50929b74c1a04954b78b4b6035e97a5e078a5a0f28ec96d547bfee9ace803ac0")
+
+func mustParseXOnly(s string) *btcec.PublicKey {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		panic(err)
+	}
+	key, err := schnorr.ParsePubKey(b)
+	if err != nil {
+		panic(err)
+	}
+	return key
+}
+
+// TaprootContract is the P2TR form of the deposit or the collateral
+// contract. Every spend path is a leaf of its own, so a script spend only
+// reveals the branch it takes, and a key-path spend reveals nothing.
+type TaprootContract struct {
+	InternalKey *btcec.PublicKey
+	OutputKey   *btcec.PublicKey
+	Address     btcutil.Address
+	PkScript    []byte
+
+	paths  []SpendPath
+	leaves []txscript.TapLeaf
+	tree   *txscript.IndexedTapScriptTree
+}
+
+// TaprootInternalKey returns the internal key of the taproot contracts:
+// terms.InternalKey when set, the MuSig2 aggregate of Alice's and Bob's keys
+// otherwise.
+func (terms *ContractTerms) TaprootInternalKey() (*btcec.PublicKey, error) {
+	if terms.InternalKey != nil {
+		return terms.InternalKey, nil
+	}
+	return MuSig2AggregateKey(terms)
+}
+
+// BuildTaprootDepositContract builds the deposit as a taproot output with a
+// Dep-A leaf (sigA, sigB, preA) and a Dep-B leaf (sigA, sigB, T, preB).
+func BuildTaprootDepositContract(terms *ContractTerms) (*TaprootContract, error) {
+	return buildTaprootContract(terms, PathDepositAlice, PathDepositBob)
+}
+
+// BuildTaprootCollateralContract builds the collateral as a taproot output
+// with a Col-B leaf (sigA, sigB, ell) and a Col-M leaf (sigA, sigB, preA,
+// preB).
+func BuildTaprootCollateralContract(terms *ContractTerms) (*TaprootContract, error) {
+	return buildTaprootContract(terms, PathCollateralBob, PathCollateralMiner)
+}
+
+func buildTaprootContract(terms *ContractTerms, paths ...SpendPath) (*TaprootContract, error) {
+	if err := terms.Validate(); err != nil {
+		return nil, err
+	}
+
+	scripts := make([][]byte, len(paths))
+	for i, path := range paths {
+		script, err := taprootLeafScript(terms, path)
+		if err != nil {
+			return nil, err
+		}
+		scripts[i] = script
+	}
+
+	return newTaprootContract(terms, paths, scripts)
+}
+
+// taprootLeafScript returns the leaf of path under terms, which are not
+// validated.
+func taprootLeafScript(terms *ContractTerms, path SpendPath) ([]byte, error) {
+	switch path {
+	case PathDepositAlice:
+		return tapLeafScript(terms, func(builder *txscript.ScriptBuilder) {
+			addHashLock(builder, terms, terms.HashA, false)
+		})
+	case PathDepositBob:
+		return tapLeafScript(terms, func(builder *txscript.ScriptBuilder) {
+			addTimelock(builder, terms.encodedT(), terms.TMode) // Bob can spend after T
+			builder.AddOp(txscript.OP_VERIFY)
+			addHashLock(builder, terms, terms.HashB, false)
+		})
+	case PathCollateralBob:
+		return tapLeafScript(terms, func(builder *txscript.ScriptBuilder) {
+			addTimelock(builder, terms.encodedEll(), terms.EllMode) // ell is left as the final true value
+		})
+	case PathCollateralMiner:
+		return tapLeafScript(terms, func(builder *txscript.ScriptBuilder) {
+			addHashLock(builder, terms, terms.HashA, true)
+			addHashLock(builder, terms, terms.HashB, false)
+		})
+	default:
+		return nil, fmt.Errorf("hehtlc: %v has no taproot leaf", path)
+	}
+}
+
+// tapLeafScript returns a leaf requiring both signatures followed by the
+// conditions added by body.
+//
+// corresponding witness
+// <body inputs> || sigB || sigA
+func tapLeafScript(terms *ContractTerms, body func(*txscript.ScriptBuilder)) ([]byte, error) {
+	builder := txscript.NewScriptBuilder()
+	addSignatureCheck(builder, terms)
+	body(builder)
+	return builder.Script()
+}
+
+func newTaprootContract(terms *ContractTerms, paths []SpendPath, scripts [][]byte) (*TaprootContract, error) {
+	leaves := make([]txscript.TapLeaf, len(scripts))
+	for i, script := range scripts {
+		leaves[i] = txscript.NewBaseTapLeaf(script)
+	}
+	tree := txscript.AssembleTaprootScriptTree(leaves...)
+
+	internalKey, err := terms.TaprootInternalKey()
+	if err != nil {
+		return nil, err
+	}
+	rootHash := tree.RootNode.TapHash()
+	outputKey := txscript.ComputeTaprootOutputKey(internalKey, rootHash[:])
+
+	addr, err := btcutil.NewAddressTaproot(schnorr.SerializePubKey(outputKey), terms.Net)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidAddress, err)
+	}
+	pkScript, err := txscript.PayToAddrScript(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	return &TaprootContract{
+		InternalKey: internalKey,
+		OutputKey:   outputKey,
+		Address:     addr,
+		PkScript:    pkScript,
+		paths:       paths,
+		leaves:      leaves,
+		tree:        tree,
+	}, nil
+}
+
+// MerkleRoot returns the root of the script tree the output key commits to.
+func (c *TaprootContract) MerkleRoot() []byte {
+	rootHash := c.tree.RootNode.TapHash()
+	return rootHash[:]
+}
+
+// LeafScript returns the leaf script of path and the control block proving it
+// is committed to by the output key.
+func (c *TaprootContract) LeafScript(path SpendPath) ([]byte, []byte, error) {
+	for i, leafPath := range c.paths {
+		if leafPath != path {
+			continue
+		}
+		proof := c.tree.LeafMerkleProofs[i]
+		controlBlock := proof.ToControlBlock(c.InternalKey)
+		controlBlockBytes, err := controlBlock.ToBytes()
+		if err != nil {
+			return nil, nil, err
+		}
+		return c.leaves[i].Script, controlBlockBytes, nil
+	}
+	return nil, nil, fmt.Errorf("hehtlc: %v is not a leaf of this contract", path)
+}
+
+// SignKeyPath returns the key-path signature of input idx of tx, which spends
+// amount from this contract, when InternalKey is a single key rather than the
+// MuSig2 aggregate (see CooperativeSession). internalKey is its private key;
+// it is tweaked with the merkle root before signing. The witness of a
+// key-path spend is the signature alone.
+func (c *TaprootContract) SignKeyPath(tx *wire.MsgTx, idx int, amount int64,
+	internalKey *btcec.PrivateKey) ([]byte, error) {
+
+	if internalKey == nil {
+		return nil, &ParamError{Field: "PrivateKey", Err: ErrMissingValue}
+	}
+	if !internalKey.PubKey().IsEqual(c.InternalKey) {
+		return nil, fmt.Errorf("%w: key is not the taproot internal key", ErrSecretMismatch)
+	}
+
+	prevOutput := txscript.NewCannedPrevOutputFetcher(c.PkScript, amount)
+	sigHashes := txscript.NewTxSigHashes(tx, prevOutput)
+
+	// the taproot tweak negates odd keys in place, so hand it a copy
+	privKey := *internalKey
+	return txscript.RawTxInTaprootSignature(tx, sigHashes, idx, amount, c.PkScript,
+		c.MerkleRoot(), txscript.SigHashDefault, &privKey)
+}
@@ -0,0 +1,136 @@
+package hehtlc
+
+import (
+	"bytes"
+	"errors"
+	"github.com/btcsuite/btcd/btcec/v2"
+	"github.com/btcsuite/btcd/btcutil/psbt"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+// genTaprootTestParams returns GenTestParams switched to the taproot
+// contracts. The collateral outpoint is derived from the taproot Dep-B.
+func genTaprootTestParams(internalKey *btcec.PublicKey) Parameters {
+	params := GenTestParams()
+	params.Terms.Taproot = true
+	params.Terms.InternalKey = internalKey
+	params.collateralUTXOForBob = fundingUTXO{}
+	params.collateralUTXOForMiner = fundingUTXO{}
+	return params
+}
+
+func TestTaprootContracts(t *testing.T) {
+	params := genTaprootTestParams(nil)
+
+	deposit, err := BuildTaprootDepositContract(&params.Terms)
+	assert.NoError(t, err)
+	collateral, err := BuildTaprootCollateralContract(&params.Terms)
+	assert.NoError(t, err)
+
+	aggregateKey, err := MuSig2AggregateKey(&params.Terms)
+	assert.NoError(t, err)
+	assert.True(t, deposit.InternalKey.IsEqual(aggregateKey))
+	assert.Equal(t, "tb1p", deposit.Address.EncodeAddress()[:4])
+	assert.NotEqual(t, deposit.PkScript, collateral.PkScript)
+
+	// Dep-B pays the taproot collateral
+	spend, err := NewUnsignedSpend(&params, PathDepositBob)
+	assert.NoError(t, err)
+	assert.Equal(t, collateral.PkScript, spend.Tx.TxOut[0].PkScript)
+
+	spends := []struct {
+		path     SpendPath
+		contract *TaprootContract
+		spend    func(*Parameters) (*SignedSpend, error)
+	}{
+		{PathDepositAlice, deposit, SpendHeHTLCDepositAlice},
+		{PathDepositBob, deposit, SpendHeHTLCDepositBob},
+		{PathCollateralBob, collateral, SpendHeHTLCCollateralBob},
+		{PathCollateralMiner, collateral, SpendHeHTLCCollateralMiner},
+	}
+	for _, s := range spends {
+		t.Run(s.path.String(), func(t *testing.T) {
+			signed, err := s.spend(&params)
+			assert.NoError(t, err)
+
+			// only the leaf of the path is revealed
+			leafScript, controlBlock, err := s.contract.LeafScript(s.path)
+			assert.NoError(t, err)
+			witness := signed.Tx.TxIn[0].Witness
+			assert.Equal(t, leafScript, witness[len(witness)-2])
+			assert.Equal(t, controlBlock, witness[len(witness)-1])
+
+			unsigned, err := NewUnsignedSpend(&params, s.path)
+			assert.NoError(t, err)
+			prevOuts := txscript.NewCannedPrevOutputFetcher(s.contract.PkScript, unsigned.Amount)
+			assert.NoError(t, VerifySpend(signed.Tx, prevOuts))
+		})
+	}
+
+	t.Run("wrong leaf", func(t *testing.T) {
+		_, _, err := deposit.LeafScript(PathCollateralBob)
+		assert.Error(t, err)
+	})
+
+	t.Run("no key path", func(t *testing.T) {
+		params := genTaprootTestParams(NUMSInternalKey)
+		_, err := SpendHeHTLCCooperative(&params)
+		assert.True(t, errors.Is(err, ErrSecretMismatch))
+	})
+}
+
+func TestTaprootKeyPath(t *testing.T) {
+	internalKey, err := btcec.NewPrivateKey()
+	assert.NoError(t, err)
+	params := genTaprootTestParams(internalKey.PubKey())
+
+	contract, err := BuildTaprootDepositContract(&params.Terms)
+	assert.NoError(t, err)
+	tx, amount, err := unsignedDepositAlice(&params, PathDepositAlice)
+	assert.NoError(t, err)
+
+	sig, err := contract.SignKeyPath(tx, 0, amount, internalKey)
+	assert.NoError(t, err)
+	assert.Len(t, sig, 64)
+	tx.TxIn[0].Witness = [][]byte{sig}
+	assert.NoError(t, VerifySpend(tx, txscript.NewCannedPrevOutputFetcher(contract.PkScript, amount)))
+
+	otherKey, err := btcec.NewPrivateKey()
+	assert.NoError(t, err)
+	_, err = contract.SignKeyPath(tx, 0, amount, otherKey)
+	assert.True(t, errors.Is(err, ErrSecretMismatch))
+	_, err = contract.SignKeyPath(tx, 0, amount, nil)
+	assert.True(t, errors.Is(err, ErrMissingValue))
+}
+
+func TestTaprootPSBT(t *testing.T) {
+	params := genTaprootTestParams(nil)
+
+	for _, path := range setupPaths {
+		t.Run(path.String(), func(t *testing.T) {
+			spend, err := NewUnsignedSpend(&params, path)
+			assert.NoError(t, err)
+			_, err = spend.SignAs(RoleAlice, params.Alice.PrivateKey)
+			assert.NoError(t, err)
+			_, err = spend.SignAs(RoleBob, params.Bob.PrivateKey)
+			assert.NoError(t, err)
+
+			packet, err := spend.ToPSBT(params.Alice.PreA, params.Bob.PreB)
+			assert.NoError(t, err)
+			encoded, err := packet.B64Encode()
+			assert.NoError(t, err)
+			packet, err = psbt.NewFromRawBytes(bytes.NewReader([]byte(encoded)), true)
+			assert.NoError(t, err)
+			assert.Len(t, packet.Inputs[0].TaprootScriptSpendSig, 2)
+
+			tx, err := FinalizePSBT(packet, &params.Terms)
+			assert.NoError(t, err)
+
+			expected, err := signLocally(&params, path)
+			assert.NoError(t, err)
+			assert.Equal(t, expected.Hex, tx.Hex)
+		})
+	}
+}
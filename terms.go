@@ -0,0 +1,522 @@
+package hehtlc
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"github.com/btcsuite/btcd/btcec/v2"
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"math"
+)
+
+// ContractTerms are the public terms of a He-HTLC that Alice and Bob agree on
+// before funding. They hold no secrets: public keys and hash locks are all the
+// deposit and collateral scripts need.
+type ContractTerms struct {
+	// Net is the network the contracts belong to.
+	Net *chaincfg.Params
+
+	AlicePubKey *btcec.PublicKey
+	BobPubKey   *btcec.PublicKey
+
+	// HashA and HashB are the hashes of preA and preB under HashFunc.
+	HashA []byte
+	HashB []byte
+
+	// HashFunc is the hash function of both hash locks. SHA256 binds a
+	// contract to the payment hash of a Lightning invoice.
+	HashFunc HashFunc
+
+	// T is the timelock after which Bob may move the deposit to the
+	// collateral, ell the one after which he may claim the collateral.
+	// TMode and EllMode tell whether each is relative or absolute, TUnit
+	// and EllUnit whether it counts blocks or seconds.
+	T       int64
+	Ell     int64
+	TMode   TimelockMode
+	EllMode TimelockMode
+	TUnit   TimelockUnit
+	EllUnit TimelockUnit
+
+	VDep int64
+	VCol int64
+	// Fee is paid by every spend without a fee rate, and reserved in the
+	// collateral output to pay for its spend.
+	Fee int64
+
+	// Taproot selects the tapscript contracts of BuildTaprootDepositContract
+	// and BuildTaprootCollateralContract instead of the P2WSH ones.
+	// InternalKey is their taproot internal key; when nil it is the MuSig2
+	// aggregate of AlicePubKey and BobPubKey, so both parties can close
+	// cooperatively through the key path. Use NUMSInternalKey to disable the
+	// key path.
+	Taproot     bool
+	InternalKey *btcec.PublicKey
+
+	// ScriptForm selects how the contracts check Alice's and Bob's
+	// signatures.
+	ScriptForm ScriptForm
+
+	// Miniscript selects the miniscript-compatible encoding of the
+	// contracts, which DepositDescriptor and CollateralDescriptor need: hash
+	// locks also check that preimages are 32 bytes and the P2WSH scripts are
+	// an or_i of two branches that each check both signatures. Spending
+	// conditions are unchanged.
+	Miniscript bool
+
+	// PreimageSize, when positive, makes every hash lock check that its
+	// preimage is exactly that many bytes with OP_SIZE <n> OP_EQUALVERIFY,
+	// so a preimage too long to be revealed on another chain cannot unlock
+	// this one. The miniscript encoding always checks 32 bytes.
+	PreimageSize int
+
+	// SigHashes sets the sighash type both parties sign a spend path with.
+	// Paths left out use SIGHASH_ALL, or SIGHASH_DEFAULT in tapscript.
+	// SIGHASH_SINGLE|ANYONECANPAY lets the broadcaster attach fee inputs
+	// and a change output with AddFeeInputs, and is refused for spends with
+	// more than one output, which it would leave unsigned, and for Dep-B,
+	// whose txid Col-B and Col-M are presigned against.
+	SigHashes map[SpendPath]txscript.SigHashType
+}
+
+// TimelockMode is how T or ell is enforced.
+type TimelockMode int
+
+const (
+	// TimelockRelative counts from the confirmation of the spent output. It
+	// is checked by OP_CHECKSEQUENCEVERIFY against the input sequence (BIP68,
+	// BIP112).
+	TimelockRelative TimelockMode = iota
+
+	// TimelockAbsolute is a block height, or a Unix time from 500000000 on.
+	// It is checked by OP_CHECKLOCKTIMEVERIFY against the transaction lock
+	// time (BIP65).
+	TimelockAbsolute
+)
+
+func (mode TimelockMode) String() string {
+	switch mode {
+	case TimelockRelative:
+		return "relative"
+	case TimelockAbsolute:
+		return "absolute"
+	default:
+		return fmt.Sprintf("TimelockMode(%d)", int(mode))
+	}
+}
+
+// maxAbsoluteLockTime is the largest nLockTime.
+const maxAbsoluteLockTime = math.MaxUint32
+
+// TimelockUnit is what T or ell counts.
+type TimelockUnit int
+
+const (
+	// TimelockBlocks counts blocks: a relative delay or a block height.
+	TimelockBlocks TimelockUnit = iota
+
+	// TimelockSeconds counts seconds: a relative delay, which BIP68 rounds
+	// up to units of 512 seconds, or a Unix time.
+	TimelockSeconds
+)
+
+func (unit TimelockUnit) String() string {
+	switch unit {
+	case TimelockBlocks:
+		return "blocks"
+	case TimelockSeconds:
+		return "seconds"
+	default:
+		return fmt.Sprintf("TimelockUnit(%d)", int(unit))
+	}
+}
+
+// maxRelativeSeconds is the longest relative delay in seconds BIP68 encodes.
+const maxRelativeSeconds = MaxRelativeLockTime << wire.SequenceLockTimeGranularity
+
+// encodeTimelock returns the value a script pushes for a timelock, which is
+// also the input sequence of a relative one and the lock time of an absolute
+// one. Relative seconds are set the BIP68 type flag and rounded up to units
+// of 512 seconds.
+func encodeTimelock(value int64, mode TimelockMode, unit TimelockUnit) int64 {
+	if mode != TimelockRelative || unit != TimelockSeconds {
+		return value
+	}
+	granularity := int64(1) << wire.SequenceLockTimeGranularity
+	return wire.SequenceLockTimeIsSeconds | (value+granularity-1)/granularity
+}
+
+// decodeTimelock is the reverse of encodeTimelock, up to its rounding.
+func decodeTimelock(encoded int64, mode TimelockMode) (int64, TimelockUnit) {
+	switch {
+	case mode == TimelockRelative && encoded&wire.SequenceLockTimeIsSeconds != 0:
+		return (encoded & wire.SequenceLockTimeMask) << wire.SequenceLockTimeGranularity, TimelockSeconds
+	case mode == TimelockAbsolute && encoded >= txscript.LockTimeThreshold:
+		return encoded, TimelockSeconds
+	default:
+		return encoded, TimelockBlocks
+	}
+}
+
+// encodedT returns T as the deposit script pushes it.
+func (terms *ContractTerms) encodedT() int64 {
+	return encodeTimelock(terms.T, terms.TMode, terms.TUnit)
+}
+
+// encodedEll returns ell as the collateral script pushes it.
+func (terms *ContractTerms) encodedEll() int64 {
+	return encodeTimelock(terms.Ell, terms.EllMode, terms.EllUnit)
+}
+
+// HashFunc is the hash function of the hash locks.
+type HashFunc int
+
+const (
+	// HashFuncHash160 is RIPEMD160(SHA256(pre)), checked by OP_HASH160.
+	HashFuncHash160 HashFunc = iota
+
+	// HashFuncSHA256 is SHA256(pre), checked by OP_SHA256.
+	HashFuncSHA256
+
+	// HashFuncHash256 is SHA256(SHA256(pre)), checked by OP_HASH256.
+	HashFuncHash256
+)
+
+// String returns the name of the hash function, which is also its miniscript
+// fragment.
+func (fn HashFunc) String() string {
+	switch fn {
+	case HashFuncHash160:
+		return "hash160"
+	case HashFuncSHA256:
+		return "sha256"
+	case HashFuncHash256:
+		return "hash256"
+	default:
+		return fmt.Sprintf("HashFunc(%d)", int(fn))
+	}
+}
+
+// Size returns the length of a hash lock in bytes.
+func (fn HashFunc) Size() int {
+	if fn == HashFuncHash160 {
+		return ripemd160Size
+	}
+	return sha256.Size
+}
+
+// Sum returns the hash lock of preimage.
+func (fn HashFunc) Sum(preimage []byte) []byte {
+	switch fn {
+	case HashFuncSHA256:
+		hash := sha256.Sum256(preimage)
+		return hash[:]
+	case HashFuncHash256:
+		return chainhash.DoubleHashB(preimage)
+	default:
+		return btcutil.Hash160(preimage)
+	}
+}
+
+// opcode returns the opcode hashing the top stack element with fn.
+func (fn HashFunc) opcode() byte {
+	switch fn {
+	case HashFuncSHA256:
+		return txscript.OP_SHA256
+	case HashFuncHash256:
+		return txscript.OP_HASH256
+	default:
+		return txscript.OP_HASH160
+	}
+}
+
+// matches tells whether preimage opens hashLock.
+func (fn HashFunc) matches(preimage, hashLock []byte) bool {
+	return bytes.Equal(fn.Sum(preimage), hashLock)
+}
+
+const ripemd160Size = 20
+
+// ScriptForm is the encoding of the two-signature check every contract
+// branch starts with.
+type ScriptForm int
+
+const (
+	// ScriptFormDefault is ScriptFormMultisig for P2WSH contracts and
+	// ScriptFormCheckSig for taproot ones.
+	ScriptFormDefault ScriptForm = iota
+
+	// ScriptFormMultisig is OP_2 <pkA> <pkB> OP_2 OP_CHECKMULTISIGVERIFY. It
+	// needs an empty NULLDUMMY element in every witness and is not allowed
+	// in tapscript.
+	ScriptFormMultisig
+
+	// ScriptFormCheckSig is <pkA> OP_CHECKSIGVERIFY <pkB> OP_CHECKSIGVERIFY.
+	ScriptFormCheckSig
+
+	// ScriptFormCheckSigAdd is <pkA> OP_CHECKSIG <pkB> OP_CHECKSIGADD OP_2
+	// OP_NUMEQUALVERIFY. OP_CHECKSIGADD only exists in tapscript.
+	ScriptFormCheckSigAdd
+)
+
+func (form ScriptForm) String() string {
+	switch form {
+	case ScriptFormDefault:
+		return "default"
+	case ScriptFormMultisig:
+		return "multisig"
+	case ScriptFormCheckSig:
+		return "checksig"
+	case ScriptFormCheckSigAdd:
+		return "checksigadd"
+	default:
+		return fmt.Sprintf("ScriptForm(%d)", int(form))
+	}
+}
+
+// signatureForm resolves ScriptFormDefault to the form the contract type
+// uses.
+func (terms *ContractTerms) signatureForm() ScriptForm {
+	if terms.ScriptForm != ScriptFormDefault {
+		return terms.ScriptForm
+	}
+	if terms.Taproot {
+		return ScriptFormCheckSig
+	}
+	return ScriptFormMultisig
+}
+
+// AliceSecrets holds what only Alice knows. It is supplied when Alice signs or
+// when a witness revealing preA is built.
+type AliceSecrets struct {
+	PrivateKey *btcutil.WIF
+	PreA       []byte
+}
+
+// BobSecrets holds what only Bob knows. It is supplied when Bob signs or when
+// a witness revealing preB is built.
+type BobSecrets struct {
+	PrivateKey *btcutil.WIF
+	PreB       []byte
+}
+
+// GetAliceBobPks returns the compressed public keys of Alice and Bob.
+func (terms *ContractTerms) GetAliceBobPks() ([]byte, []byte) {
+	return terms.AlicePubKey.SerializeCompressed(), terms.BobPubKey.SerializeCompressed()
+}
+
+func (terms *ContractTerms) pubKey(role Role) (*btcec.PublicKey, error) {
+	switch role {
+	case RoleAlice:
+		return terms.AlicePubKey, nil
+	case RoleBob:
+		return terms.BobPubKey, nil
+	default:
+		return nil, fmt.Errorf("hehtlc: unknown role %v", role)
+	}
+}
+
+// Validate checks that terms are complete, that vdep/vcol/fee are positive,
+// that T and ell are valid BIP68 relative or BIP65 absolute lock-times in
+// their mode and unit and that the script form suits the contract type.
+func (terms *ContractTerms) Validate() error {
+	if terms.Net == nil {
+		return &ParamError{Field: "Net", Err: ErrMissingValue}
+	}
+	if terms.AlicePubKey == nil {
+		return &ParamError{Field: "AlicePubKey", Err: ErrMissingValue}
+	}
+	if terms.BobPubKey == nil {
+		return &ParamError{Field: "BobPubKey", Err: ErrMissingValue}
+	}
+
+	switch terms.HashFunc {
+	case HashFuncHash160, HashFuncSHA256, HashFuncHash256:
+	default:
+		return paramErrorf("HashFunc", ErrInvalidHashLock, "unknown hash function %v", terms.HashFunc)
+	}
+
+	hashes := []struct {
+		field string
+		hash  []byte
+	}{
+		{"HashA", terms.HashA},
+		{"HashB", terms.HashB},
+	}
+	for _, h := range hashes {
+		if len(h.hash) == 0 {
+			return &ParamError{Field: h.field, Err: ErrMissingValue}
+		}
+		if len(h.hash) != terms.HashFunc.Size() {
+			return paramErrorf(h.field, ErrInvalidHashLock, "got %d bytes, want %d for %v",
+				len(h.hash), terms.HashFunc.Size(), terms.HashFunc)
+		}
+	}
+
+	amounts := []struct {
+		field  string
+		amount int64
+	}{
+		{"VDep", terms.VDep},
+		{"VCol", terms.VCol},
+		{"Fee", terms.Fee},
+	}
+	for _, a := range amounts {
+		if a.amount <= 0 {
+			return paramErrorf(a.field, ErrNonPositiveAmount, "got %d", a.amount)
+		}
+	}
+
+	timelocks := []struct {
+		field string
+		value int64
+		mode  TimelockMode
+		unit  TimelockUnit
+	}{
+		{"T", terms.T, terms.TMode, terms.TUnit},
+		{"Ell", terms.Ell, terms.EllMode, terms.EllUnit},
+	}
+	for _, tl := range timelocks {
+		if err := checkTimelock(tl.field, tl.value, tl.mode, tl.unit); err != nil {
+			return err
+		}
+	}
+	if terms.TMode == TimelockAbsolute && terms.EllMode == TimelockAbsolute &&
+		terms.TUnit == terms.EllUnit && terms.Ell <= terms.T {
+		return paramErrorf("Ell", ErrTimelockOutOfRange,
+			"absolute ell %d must come after absolute T %d", terms.Ell, terms.T)
+	}
+
+	switch {
+	case terms.PreimageSize < 0 || terms.PreimageSize > txscript.MaxScriptElementSize:
+		return paramErrorf("PreimageSize", ErrInvalidHashLock, "%d not in [0, %d]",
+			terms.PreimageSize, txscript.MaxScriptElementSize)
+	case terms.Miniscript && terms.PreimageSize != 0 && terms.PreimageSize != miniscriptPreimageSize:
+		return paramErrorf("PreimageSize", ErrInvalidHashLock, "miniscript checks %d-byte preimages",
+			miniscriptPreimageSize)
+	}
+
+	for path, hashType := range terms.SigHashes {
+		switch {
+		case path < PathDepositAlice || path > PathCollateralMiner:
+			return paramErrorf("SigHashes", ErrInvalidSigHash, "%v is not signed by both parties", path)
+		case path == PathDepositBob && hashType&sigHashMask == txscript.SigHashSingle:
+			return paramErrorf("SigHashes", ErrInvalidSigHash,
+				"%v for %v would change the txid the collateral spends are signed against", hashType, path)
+		case hashType == txscript.SigHashDefault && terms.Taproot:
+		case hashType == txscript.SigHashAll, hashType == sigHashSingleAnyoneCanPay:
+		default:
+			return paramErrorf("SigHashes", ErrInvalidSigHash, "%v for %v", hashType, path)
+		}
+	}
+
+	switch terms.ScriptForm {
+	case ScriptFormDefault, ScriptFormCheckSig:
+	case ScriptFormMultisig:
+		if terms.Taproot {
+			return paramErrorf("ScriptForm", ErrInvalidScriptForm, "OP_CHECKMULTISIG is disabled in tapscript")
+		}
+	case ScriptFormCheckSigAdd:
+		if !terms.Taproot {
+			return paramErrorf("ScriptForm", ErrInvalidScriptForm, "OP_CHECKSIGADD needs a taproot contract")
+		}
+	default:
+		return paramErrorf("ScriptForm", ErrInvalidScriptForm, "unknown form %v", terms.ScriptForm)
+	}
+
+	return nil
+}
+
+func checkTimelock(field string, value int64, mode TimelockMode, unit TimelockUnit) error {
+	if mode != TimelockRelative && mode != TimelockAbsolute {
+		return paramErrorf(field+"Mode", ErrTimelockOutOfRange, "unknown mode %v", mode)
+	}
+
+	// absolute heights and times share nLockTime, split at LockTimeThreshold
+	var min, max int64
+	switch {
+	case unit == TimelockBlocks && mode == TimelockRelative:
+		min, max = 1, MaxRelativeLockTime
+	case unit == TimelockBlocks:
+		min, max = 1, txscript.LockTimeThreshold-1
+	case unit == TimelockSeconds && mode == TimelockRelative:
+		min, max = 1, maxRelativeSeconds
+	case unit == TimelockSeconds:
+		min, max = txscript.LockTimeThreshold, maxAbsoluteLockTime
+	default:
+		return paramErrorf(field+"Unit", ErrTimelockOutOfRange, "unknown unit %v", unit)
+	}
+	if value < min || value > max {
+		return paramErrorf(field, ErrTimelockOutOfRange, "%v %d %v not in [%d, %d]", mode, value, unit, min, max)
+	}
+	return nil
+}
+
+// sigHashType returns the sighash type of the signatures spending path.
+func (terms *ContractTerms) sigHashType(path SpendPath) txscript.SigHashType {
+	if hashType, ok := terms.SigHashes[path]; ok {
+		return hashType
+	}
+	if terms.Taproot {
+		return txscript.SigHashDefault
+	}
+	return txscript.SigHashAll
+}
+
+// sigHashSingleAnyoneCanPay is the sighash type fee inputs can be added to.
+const sigHashSingleAnyoneCanPay = txscript.SigHashSingle | txscript.SigHashAnyOneCanPay
+
+// sigHashMask selects the base type of a sighash type, without
+// SIGHASH_ANYONECANPAY.
+const sigHashMask = 0x1f
+
+// preimageSize returns the preimage length the hash locks check, 0 if they
+// accept any.
+func (terms *ContractTerms) preimageSize() int {
+	if terms.Miniscript {
+		return miniscriptPreimageSize
+	}
+	return terms.PreimageSize
+}
+
+// miniscriptPreimageSize is the preimage length the miniscript hash fragments
+// check.
+const miniscriptPreimageSize = 32
+
+// Check makes sure the secrets match Alice's side of terms.
+func (s *AliceSecrets) Check(terms *ContractTerms) error {
+	return checkSecrets("Alice.PrivateKey", "Alice.PreA", s.PrivateKey, s.PreA, terms.AlicePubKey,
+		terms, terms.HashA)
+}
+
+// Check makes sure the secrets match Bob's side of terms.
+func (s *BobSecrets) Check(terms *ContractTerms) error {
+	return checkSecrets("Bob.PrivateKey", "Bob.PreB", s.PrivateKey, s.PreB, terms.BobPubKey,
+		terms, terms.HashB)
+}
+
+func checkSecrets(keyField, preField string, key *btcutil.WIF, preimage []byte,
+	pubKey *btcec.PublicKey, terms *ContractTerms, hashLock []byte) error {
+
+	if key == nil {
+		return &ParamError{Field: keyField, Err: ErrMissingValue}
+	}
+	if pubKey != nil && !key.PrivKey.PubKey().IsEqual(pubKey) {
+		return paramErrorf(keyField, ErrSecretMismatch, "key does not match the contract public key")
+	}
+	if len(preimage) == 0 {
+		return nil
+	}
+	if size := terms.preimageSize(); size > 0 && len(preimage) != size {
+		return paramErrorf(preField, ErrSecretMismatch, "preimage is %d bytes, the hash lock checks %d",
+			len(preimage), size)
+	}
+	if hashLock != nil && !terms.HashFunc.matches(preimage, hashLock) {
+		return paramErrorf(preField, ErrSecretMismatch, "preimage does not match the hash lock")
+	}
+	return nil
+}
@@ -0,0 +1,55 @@
+package hehtlc
+
+import (
+	"fmt"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+)
+
+// VerifyFlags are the script flags spends are checked with: the standard
+// relay policy, which covers CSV, CLTV, witness, NULLDUMMY, NULLFAIL, low-S
+// and minimal IF among others. A spend passing them is both valid and
+// standard.
+const VerifyFlags = txscript.StandardVerifyFlags
+
+// VerifySpend runs the script engine on every input of tx against the output
+// it spends, as returned by prevOuts. A transaction that would fail
+// consensus or standardness is reported with ErrScriptVerify. P2A inputs
+// with an empty witness, standard since Bitcoin Core 28 but unknown to the
+// btcd standard flags, are accepted.
+func VerifySpend(tx *wire.MsgTx, prevOuts txscript.PrevOutputFetcher) error {
+	sigHashes := txscript.NewTxSigHashes(tx, prevOuts)
+
+	for i := range tx.TxIn {
+		if err := verifyInput(tx, i, prevOuts, sigHashes); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// verifyInput runs the script engine on input i of tx.
+func verifyInput(tx *wire.MsgTx, i int, prevOuts txscript.PrevOutputFetcher,
+	sigHashes *txscript.TxSigHashes) error {
+
+	txIn := tx.TxIn[i]
+	prevOut := prevOuts.FetchPrevOutput(txIn.PreviousOutPoint)
+	if prevOut == nil {
+		return fmt.Errorf("%w: input %d: unknown prevout %v",
+			ErrScriptVerify, i, txIn.PreviousOutPoint)
+	}
+	if isPayToAnchor(prevOut.PkScript) && len(txIn.SignatureScript) == 0 && len(txIn.Witness) == 0 {
+		return nil
+	}
+
+	engine, err := txscript.NewEngine(prevOut.PkScript, tx, i, VerifyFlags,
+		nil, sigHashes, prevOut.Value, prevOuts)
+	if err != nil {
+		return fmt.Errorf("%w: input %d: %v", ErrScriptVerify, i, err)
+	}
+	if err := engine.Execute(); err != nil {
+		return fmt.Errorf("%w: input %d: %v", ErrScriptVerify, i, err)
+	}
+	return nil
+}
@@ -0,0 +1,54 @@
+package hehtlc
+
+import (
+	"errors"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestVerifySpend(t *testing.T) {
+	params := GenTestParams()
+
+	depositScript, _, err := BuildDepositContract(&params.Terms)
+	assert.NoError(t, err)
+	depositPkScript, err := p2wshScript(depositScript)
+	assert.NoError(t, err)
+	prevOuts := txscript.NewCannedPrevOutputFetcher(depositPkScript, params.depositUTXOForBob.amount)
+
+	txDepBob, err := SpendHeHTLCDepositBob(&params)
+	assert.NoError(t, err)
+	assert.NoError(t, VerifySpend(txDepBob.Tx, prevOuts))
+
+	t.Run("amount", func(t *testing.T) {
+		wrongAmount := txscript.NewCannedPrevOutputFetcher(depositPkScript, params.depositUTXOForBob.amount-1)
+		assert.True(t, errors.Is(VerifySpend(txDepBob.Tx, wrongAmount), ErrScriptVerify))
+	})
+
+	t.Run("relative timelock", func(t *testing.T) {
+		tx := txDepBob.Tx.Copy()
+		tx.TxIn[0].Sequence = uint32(params.Terms.T - 1)
+		assert.True(t, errors.Is(VerifySpend(tx, prevOuts), ErrScriptVerify))
+	})
+
+	t.Run("null dummy", func(t *testing.T) {
+		tx := txDepBob.Tx.Copy()
+		tx.TxIn[0].Witness[2] = []byte{0x01}
+		assert.True(t, errors.Is(VerifySpend(tx, prevOuts), ErrScriptVerify))
+	})
+
+	t.Run("finalize refuses invalid spends", func(t *testing.T) {
+		spend, err := NewUnsignedSpend(&params, PathDepositBob)
+		assert.NoError(t, err)
+
+		// a Dep-B that does not wait for T, signed by both
+		spend.Tx.TxIn[0].Sequence = 0
+		_, err = spend.SignAs(RoleAlice, params.Alice.PrivateKey)
+		assert.NoError(t, err)
+		_, err = spend.SignAs(RoleBob, params.Bob.PrivateKey)
+		assert.NoError(t, err)
+
+		_, err = spend.Finalize(nil, params.Bob.PreB)
+		assert.True(t, errors.Is(err, ErrScriptVerify))
+	})
+}